@@ -0,0 +1,130 @@
+// Command jaeger-mongodb-dependencies periodically rolls up the dependency
+// links of the spans collection into the dependencies collection, from which
+// the plugin serves GetDependencies when mongo_dependencies_interval is set.
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	jaeger_mongodb "jaeger-mongodb/internal/jaeger-mongodb"
+)
+
+var (
+	configPath string
+	once       bool
+)
+
+// indexTimeout bounds the creation of the indexes of the dependencies
+// collection.
+const indexTimeout = 5 * time.Minute
+
+func main() {
+	flag.StringVar(&configPath, "config", "", "A path to the plugin's configuration file")
+	flag.BoolVar(&once, "once", false, "Roll up the pending intervals and exit, e.g. when run as a cron job")
+	flag.Parse()
+
+	logger := hclog.New(&hclog.LoggerOptions{
+		Name:       "jaeger-mongodb-dependencies",
+		Level:      hclog.Info,
+		JSONFormat: true,
+	})
+
+	v := viper.New()
+	v.AutomaticEnv()
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
+	if configPath != "" {
+		v.SetConfigFile(configPath)
+		if err := v.ReadInConfig(); err != nil {
+			logger.Error("failed to parse configuration file", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	opts := jaeger_mongodb.Options{}
+	opts.InitFromViper(v)
+	if opts.Configuration.MongoDependenciesInterval <= 0 {
+		logger.Error("mongo_dependencies_interval must be set to roll up dependency links")
+		os.Exit(1)
+	}
+	layout, err := jaeger_mongodb.ParseLayout(opts.Configuration.MongoLayout)
+	if err != nil {
+		logger.Error("invalid mongo_layout", "err", err)
+		os.Exit(1)
+	}
+	retention, err := jaeger_mongodb.NewRetention(opts.Configuration.MongoSpanTTLDuration, opts.Configuration.MongoServiceTTL)
+	if err != nil {
+		logger.Error("invalid mongo_service_ttl", "err", err)
+		os.Exit(1)
+	}
+	// Links are kept and rolled up as long as the spans of any service.
+	ttl := retention.Max()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	connectCtx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	m, err := mongo.Connect(connectCtx, options.Client().ApplyURI(opts.Configuration.MongoUrl))
+	if err != nil {
+		logger.Error("failed to connect", "err", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := m.Disconnect(context.Background()); err != nil {
+			logger.Error("failed to disconnect", "err", err)
+		}
+	}()
+
+	db := m.Database(opts.Configuration.MongoDatabase)
+	dependencies := db.Collection(opts.Configuration.MongoDependenciesCollection)
+
+	// Index builds on large collections outlast the connection timeout.
+	indexCtx, cancelIndexes := context.WithTimeout(ctx, indexTimeout)
+	defer cancelIndexes()
+	indexes := jaeger_mongodb.DependenciesIndexes(ttl)
+	if _, err := jaeger_mongodb.CreateIndexes(indexCtx, dependencies, indexes); err != nil {
+		logger.Error("could not create indexes", "err", err)
+	}
+	if opts.Configuration.MongoApplyTTL {
+		diff, err := jaeger_mongodb.CompareIndexes(indexCtx, dependencies, indexes)
+		if err != nil {
+			logger.Error("could not compare indexes", "err", err)
+		}
+		for _, change := range diff.TTLChanges {
+			if err := jaeger_mongodb.UpdateTTL(indexCtx, db, change); err != nil {
+				logger.Error("could not change retention", "err", err)
+				continue
+			}
+			logger.Warn("changed retention", "collection", change.Collection, "index", change.Index, "old", change.Old.String(), "new", change.New.String())
+		}
+	}
+
+	rollup := jaeger_mongodb.NewDependenciesRollup(
+		db.Collection(opts.Configuration.MongoCollection),
+		dependencies,
+		logger,
+		opts.Configuration.MongoDependenciesInterval,
+		opts.Configuration.MongoDependenciesDelay,
+		ttl,
+		opts.Configuration.MongoDependenciesInterval, // a rollup must finish before the next one is due
+	).WithLayout(layout)
+
+	if once {
+		if err := rollup.RollupPending(ctx, time.Now()); err != nil {
+			logger.Error("error rolling up dependency links", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+	rollup.Run(ctx)
+}
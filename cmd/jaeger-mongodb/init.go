@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	jaeger_mongodb "jaeger-mongodb/internal/jaeger-mongodb"
+)
+
+// runInit implements the init subcommand, which creates the collections and
+// indexes of the configuration ahead of the plugin's first start, and returns
+// the exit code. Every change is printed; running it again changes nothing.
+func runInit(args []string) int {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "", "A path to the plugin's configuration file")
+	timeout := flags.Duration("timeout", indexTimeout, "Maximum time to create the collections and indexes")
+	flags.Parse(args)
+
+	opts, err := loadOptions(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse configuration file: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	m, err := mongo.Connect(ctx, options.Client().ApplyURI(opts.Configuration.MongoUrl))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect: %v\n", err)
+		return 1
+	}
+	defer func() {
+		disconnectCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		m.Disconnect(disconnectCtx)
+	}()
+
+	changes, err := jaeger_mongodb.Bootstrap(ctx, m.Database(opts.Configuration.MongoDatabase), opts.Configuration)
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "init failed: %v\n", err)
+		return 1
+	}
+	if len(changes) == 0 {
+		fmt.Println("nothing to change")
+	}
+	return 0
+}
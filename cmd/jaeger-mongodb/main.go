@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"strings"
@@ -11,10 +12,8 @@ import (
 	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc"
 	"github.com/jaegertracing/jaeger/plugin/storage/grpc/shared"
-	"github.com/jaegertracing/jaeger/storage/dependencystore"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/spf13/viper"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/writeconcern"
@@ -28,7 +27,37 @@ import (
 
 var configPath string
 
+// indexTimeout bounds the creation of the collections and indexes.
+const indexTimeout = 5 * time.Minute
+
+// loadOptions reads the configuration from the file at configPath, if any, and
+// the environment.
+func loadOptions(configPath string) (jaeger_mongodb.Options, error) {
+	v := viper.New()
+	v.AutomaticEnv()
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
+	if configPath != "" { // If configPath is absent from arguments, set default config
+		v.SetConfigFile(configPath)
+		if err := v.ReadInConfig(); err != nil {
+			return jaeger_mongodb.Options{}, err
+		}
+	}
+
+	opts := jaeger_mongodb.Options{}
+	opts.InitFromViper(v)
+	return opts, nil
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "init":
+			os.Exit(runInit(os.Args[2:]))
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		}
+	}
+
 	flag.StringVar(&configPath, "config", "", "A path to the plugin's configuration file")
 	flag.Parse()
 
@@ -38,20 +67,31 @@ func main() {
 		JSONFormat: true,
 	})
 
-	v := viper.New()
-	v.AutomaticEnv()
-	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
-	if configPath != "" { // If configPath is absent from arguments, set default config
-		v.SetConfigFile(configPath)
-		err := v.ReadInConfig()
-		if err != nil {
-			logger.Error("failed to parse configuration file", "err", err)
-			os.Exit(1)
-		}
+	opts, err := loadOptions(configPath)
+	if err != nil {
+		logger.Error("failed to parse configuration file", "err", err)
+		os.Exit(1)
 	}
 
-	opts := jaeger_mongodb.Options{}
-	opts.InitFromViper(v)
+	tagMatch, err := jaeger_mongodb.ParseTagMatchMode(opts.Configuration.MongoTagMatch)
+	if err != nil {
+		logger.Error("invalid mongo_tag_match", "err", err)
+		os.Exit(1)
+	}
+	layout, err := jaeger_mongodb.ParseLayout(opts.Configuration.MongoLayout)
+	if err != nil {
+		logger.Error("invalid mongo_layout", "err", err)
+		os.Exit(1)
+	}
+	retention, err := jaeger_mongodb.NewRetention(opts.Configuration.MongoSpanTTLDuration, opts.Configuration.MongoServiceTTL)
+	if err != nil {
+		logger.Error("invalid mongo_service_ttl", "err", err)
+		os.Exit(1)
+	}
+	if retention.PerService() && layout == jaeger_mongodb.LayoutTimeSeries {
+		logger.Error("invalid mongo_service_ttl", "err", jaeger_mongodb.ErrPerServiceTimeSeries)
+		os.Exit(1)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
 	defer cancel()
@@ -66,8 +106,63 @@ func main() {
 
 	collection := m.Database(opts.Configuration.MongoDatabase).Collection(opts.Configuration.MongoCollection)
 	readerStorage := jaeger_mongodb.NewMongoReaderStorage(collection)
+	archiveCollection := m.Database(opts.Configuration.MongoDatabase).Collection(opts.Configuration.MongoArchiveCollection)
+	archiveReaderStorage := jaeger_mongodb.NewMongoReaderStorage(archiveCollection)
+
+	// Index builds on large collections outlast the connection timeout.
+	indexCtx, cancelIndexes := context.WithTimeout(context.Background(), indexTimeout)
+	defer cancelIndexes()
+
+	create := opts.Configuration.MongoBootstrap
+	verify := opts.Configuration.MongoVerifyIndexes
+	applyTTL := opts.Configuration.MongoApplyTTL
+	// Documents without an expireAt date are kept as long as the spans of
+	// any service.
+	ttl := retention.Max()
+	spanIndexes := jaeger_mongodb.SpanIndexes(ttl)
+	switch layout {
+	case jaeger_mongodb.LayoutTrace:
+		spanIndexes = jaeger_mongodb.TraceIndexes(ttl)
+	case jaeger_mongodb.LayoutTimeSeries:
+		spanIndexes = jaeger_mongodb.TimeSeriesIndexes()
+		db := m.Database(opts.Configuration.MongoDatabase)
+		if create {
+			if _, err := jaeger_mongodb.CreateTimeSeriesCollection(indexCtx, db, opts.Configuration.MongoCollection, ttl); err != nil {
+				logger.Error("failed to create time-series collection", "err", err)
+				os.Exit(1)
+			}
+		}
+		change, err := jaeger_mongodb.TimeSeriesTTLChange(indexCtx, db, opts.Configuration.MongoCollection, ttl)
+		if err != nil {
+			// Spans written to a missing collection would create an
+			// ordinary one.
+			logger.Error("invalid time-series collection, run jaeger-mongodb init to create it", "collection", opts.Configuration.MongoCollection, "err", err)
+			os.Exit(1)
+		}
+		if change != nil {
+			updateTTL(indexCtx, logger, db, *change, applyTTL)
+		}
+	}
+	if retention.PerService() {
+		spanIndexes = append(spanIndexes, jaeger_mongodb.ExpireAtIndex())
+	}
+	if err := ensureIndexes(indexCtx, logger, collection, spanIndexes, create, verify, applyTTL); err != nil {
+		logger.Error("failed to verify indexes", "err", err)
+		os.Exit(1)
+	}
+	if err := ensureIndexes(indexCtx, logger, archiveCollection, jaeger_mongodb.ArchiveIndexes(), create, verify, applyTTL); err != nil {
+		logger.Error("failed to verify indexes", "err", err)
+		os.Exit(1)
+	}
 
-	createIndexes(ctx, logger, collection, opts)
+	var catalogCollection *mongo.Collection
+	if opts.Configuration.MongoCatalogCollection != "" {
+		catalogCollection = m.Database(opts.Configuration.MongoDatabase).Collection(opts.Configuration.MongoCatalogCollection)
+		if err := ensureIndexes(indexCtx, logger, catalogCollection, jaeger_mongodb.CatalogIndexes(ttl), create, verify, applyTTL); err != nil {
+			logger.Error("failed to verify indexes", "err", err)
+			os.Exit(1)
+		}
+	}
 
 	defer func() {
 		if err = m.Disconnect(ctx); err != nil {
@@ -98,68 +193,114 @@ func main() {
 		}(ctx)
 	}
 
-	plugin := &mongoStorePlugin{
-		reader: jaeger_mongodb.NewSpanReader(readerStorage, logger, opts.Configuration.MongoTimeoutDuration),
-		writer: jaeger_mongodb.NewSpanWriter(collection, logger),
+	spanWriter := jaeger_mongodb.NewSpanWriter(collection, logger, opts.Configuration.MongoMaxBinarySize).
+		WithLayout(layout)
+	if retention.PerService() {
+		spanWriter.WithRetention(retention)
+	}
+	if catalogCollection != nil {
+		spanWriter.WithCatalog(catalogCollection)
+	}
+	var writer spanstore.Writer = spanWriter
+	if opts.Configuration.MongoWriterQueueSize > 0 {
+		bufferedWriter, err := jaeger_mongodb.NewBufferedSpanWriter(
+			spanWriter,
+			opts.Configuration.MongoWriterQueueSize,
+			opts.Configuration.MongoWriterBatchSize,
+			opts.Configuration.MongoWriterFlushInterval,
+			opts.Configuration.MongoTimeoutDuration,
+		)
+		if err != nil {
+			logger.Error("invalid span writer configuration", "err", err)
+			os.Exit(1)
+		}
+		writer = bufferedWriter
 	}
 
+	reader := jaeger_mongodb.NewSpanReader(readerStorage, logger, opts.Configuration.MongoTimeoutDuration).
+		WithTagMatch(tagMatch).
+		WithLayout(layout)
+	if opts.Configuration.MongoDependenciesInterval > 0 {
+		// Links are rolled up by cmd/jaeger-mongodb-dependencies.
+		dependenciesCollection := m.Database(opts.Configuration.MongoDatabase).Collection(opts.Configuration.MongoDependenciesCollection)
+		reader.WithDependenciesStorage(jaeger_mongodb.NewMongoReaderStorage(dependenciesCollection))
+	}
+	if catalogCollection != nil {
+		reader.WithCatalogStorage(jaeger_mongodb.NewMongoReaderStorage(catalogCollection))
+	}
+
+	plugin := jaeger_mongodb.NewStorePlugin(
+		reader,
+		writer,
+		jaeger_mongodb.NewSpanReader(archiveReaderStorage, logger, opts.Configuration.MongoTimeoutDuration),
+		jaeger_mongodb.NewArchiveSpanWriter(archiveCollection, logger, opts.Configuration.MongoMaxBinarySize),
+	)
+
 	grpc.Serve(&shared.PluginServices{
-		Store: plugin,
+		Store:               plugin,
+		ArchiveStore:        plugin,
+		StreamingSpanWriter: plugin,
 	})
 
+	// Flush any buffered spans before disconnecting from MongoDB.
+	if err := plugin.Close(); err != nil {
+		logger.Error("failed to close span writer", "err", err)
+	}
+}
+
+// ensureIndexes creates the missing indexes of the collection if create is
+// set, and changes the expiry of TTL indexes that differ from the desired one
+// if applyTTL is set. If verify is set, it then fails when the indexes diverge
+// from the desired set.
+func ensureIndexes(ctx context.Context, logger hclog.Logger, collection *mongo.Collection, indexes []mongo.IndexModel, create bool, verify bool, applyTTL bool) error {
+	if create {
+		if _, err := jaeger_mongodb.CreateIndexes(ctx, collection, indexes); err != nil {
+			logger.Error("could not create indexes", "collection", collection.Name(), "err", err)
+		}
+	}
+	diff, err := jaeger_mongodb.CompareIndexes(ctx, collection, indexes)
+	if err != nil {
+		if verify {
+			return err
+		}
+		logger.Error("could not compare indexes", "collection", collection.Name(), "err", err)
+		return nil
+	}
+	if len(diff.Rebuild) != 0 {
+		// Rebuilding indexes of a large collection on every replica's start
+		// would be slow and racy, so it is left to the init subcommand.
+		logger.Warn("indexes have changed keys, run jaeger-mongodb init to rebuild them", "collection", collection.Name(), "indexes", strings.Join(diff.Rebuild, ", "))
+	}
+	for _, change := range diff.TTLChanges {
+		updateTTL(ctx, logger, collection.Database(), change, applyTTL)
+	}
+	if !verify {
+		return nil
+	}
+	if applyTTL && len(diff.TTLChanges) != 0 {
+		if diff, err = jaeger_mongodb.CompareIndexes(ctx, collection, indexes); err != nil {
+			return err
+		}
+	}
+	if diff.Diverged() {
+		return fmt.Errorf("indexes diverge: %s", diff)
+	}
+	return nil
 }
 
-func createIndexes(ctx context.Context, logger hclog.Logger, collection *mongo.Collection, opts jaeger_mongodb.Options) {
-	ttlIndex := mongo.IndexModel{
-		Keys: bson.M{"startTime": 1},
-		Options: &options.IndexOptions{
-			ExpireAfterSeconds: Int32(int32(opts.Configuration.MongoSpanTTLDuration.Seconds())),
-			Name:               String("TTLIndex"),
-		},
-	}
-
-	serviceNameIndex := mongo.IndexModel{
-		Keys: bson.D{
-			bson.E{Key: "process.serviceName", Value: 1},
-			bson.E{Key: "operationName", Value: 1},
-			bson.E{Key: "startTime", Value: -1},
-		},
-		Options: &options.IndexOptions{
-			Name: String("ServiceNameAndOperationsIndex"),
-		},
-	}
-
-	traceIDIndex := mongo.IndexModel{
-		Keys: bson.M{"traceID": 1},
-		Options: &options.IndexOptions{
-			Name: String("TraceIDIndex"),
-		},
-	}
-
-	tagsIndex := mongo.IndexModel{
-		Keys: bson.D{
-			bson.E{Key: "process.ServiceName", Value: 1},
-			bson.E{Key: "operationName", Value: 1},
-			bson.E{Key: "tags.key", Value: 1},
-			bson.E{Key: "tags.value", Value: 1},
-			bson.E{Key: "startTime", Value: -1},
-		},
-		Options: &options.IndexOptions{
-			Name: String("TagsIndex"),
-		},
-	}
-
-	if _, err := collection.Indexes().CreateMany(
-		ctx,
-		[]mongo.IndexModel{
-			ttlIndex,
-			serviceNameIndex,
-			traceIDIndex,
-			tagsIndex,
-		},
-	); err != nil {
-		logger.Error("Could not create indexes:", err)
+// updateTTL applies the retention change if apply is set, and otherwise
+// reports that the configured retention is not in force.
+func updateTTL(ctx context.Context, logger hclog.Logger, db *mongo.Database, change jaeger_mongodb.TTLChange, apply bool) {
+	args := []interface{}{"collection", change.Collection, "index", change.Index, "old", change.Old.String(), "new", change.New.String()}
+	if !apply {
+		logger.Warn("retention differs from mongo_span_ttl_duration, set mongo_apply_ttl to change it", args...)
+		return
+	}
+	if err := jaeger_mongodb.UpdateTTL(ctx, db, change); err != nil {
+		logger.Error("could not change retention", append(args, "err", err)...)
+		return
 	}
+	logger.Warn("changed retention", args...)
 }
 
 func setupTraceExporter(url string, ratio float64) (*tracesdk.TracerProvider, error) {
@@ -178,28 +319,3 @@ func setupTraceExporter(url string, ratio float64) (*tracesdk.TracerProvider, er
 	)
 	return tp, nil
 }
-
-type mongoStorePlugin struct {
-	reader *jaeger_mongodb.SpanReader
-	writer *jaeger_mongodb.SpanWriter
-}
-
-func (s *mongoStorePlugin) DependencyReader() dependencystore.Reader {
-	return s.reader
-}
-
-func (s *mongoStorePlugin) SpanReader() spanstore.Reader {
-	return s.reader
-}
-
-func (s *mongoStorePlugin) SpanWriter() spanstore.Writer {
-	return s.writer
-}
-
-func Int32(i int32) *int32 {
-	return &i
-}
-
-func String(s string) *string {
-	return &s
-}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	jaeger_mongodb "jaeger-mongodb/internal/jaeger-mongodb"
+)
+
+// runMigrate implements the migrate subcommand, which upgrades the span
+// documents of the spans and archive collections to the current schema
+// version, and returns the exit code. An interrupted migration resumes where
+// it stopped when run again.
+func runMigrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "", "A path to the plugin's configuration file")
+	batchSize := flags.Int("batch-size", 1000, "Number of documents upgraded at a time")
+	timeout := flags.Duration("timeout", 0, "Maximum time to run the migration, unlimited if 0")
+	flags.Parse(args)
+
+	opts, err := loadOptions(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse configuration file: %v\n", err)
+		return 1
+	}
+	layout, err := jaeger_mongodb.ParseLayout(opts.Configuration.MongoLayout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse configuration file: %v\n", err)
+		return 1
+	}
+	if *batchSize <= 0 {
+		fmt.Fprintf(os.Stderr, "invalid batch size %d\n", *batchSize)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	m, err := mongo.Connect(ctx, options.Client().ApplyURI(opts.Configuration.MongoUrl))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to connect: %v\n", err)
+		return 1
+	}
+	defer func() {
+		disconnectCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		m.Disconnect(disconnectCtx)
+	}()
+
+	db := m.Database(opts.Configuration.MongoDatabase)
+	migrator := jaeger_mongodb.NewMigrator(db.Collection(opts.Configuration.MongoMigrationsCollection), nil, *batchSize)
+
+	collections := []struct {
+		name   string
+		layout jaeger_mongodb.Layout
+	}{
+		{opts.Configuration.MongoCollection, layout},
+		{opts.Configuration.MongoArchiveCollection, jaeger_mongodb.LayoutSpan},
+	}
+	for _, c := range collections {
+		namespace := db.Name() + "." + c.name
+		if c.layout == jaeger_mongodb.LayoutTimeSeries {
+			// Spans of older versions remain readable until they expire.
+			fmt.Printf("skipped time-series collection %s\n", namespace)
+			continue
+		}
+		migrated, err := migrator.Migrate(ctx, db.Collection(c.name), c.layout)
+		fmt.Printf("migrated %d documents of %s to schema version %d\n", migrated, namespace, jaeger_mongodb.SchemaVersion)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "migrate failed, run it again to resume: %v\n", err)
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,276 @@
+package jaeger_mongodb
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// spanSchema is the JSON schema of span documents.
+var spanSchema = bson.D{
+	{Key: "bsonType", Value: "object"},
+	{Key: "required", Value: bson.A{"traceID", "spanID", "operationName", "startTime", "duration", "process"}},
+	{Key: "properties", Value: bson.D{
+		{Key: "schemaVersion", Value: bson.D{{Key: "bsonType", Value: "int"}}},
+		{Key: "traceID", Value: bson.D{{Key: "bsonType", Value: "string"}}},
+		{Key: "spanID", Value: bson.D{{Key: "bsonType", Value: "string"}}},
+		{Key: "operationName", Value: bson.D{{Key: "bsonType", Value: "string"}}},
+		{Key: "startTime", Value: bson.D{{Key: "bsonType", Value: "date"}}},
+		{Key: "expireAt", Value: bson.D{{Key: "bsonType", Value: "date"}}},
+		{Key: "duration", Value: bson.D{{Key: "bsonType", Value: bson.A{"int", "long"}}}},
+		{Key: "process", Value: bson.D{
+			{Key: "bsonType", Value: "object"},
+			{Key: "required", Value: bson.A{"serviceName"}},
+			{Key: "properties", Value: bson.D{
+				{Key: "serviceName", Value: bson.D{{Key: "bsonType", Value: "string"}}},
+			}},
+		}},
+	}},
+}
+
+// traceSchema is the JSON schema of TraceDocuments.
+var traceSchema = bson.D{
+	{Key: "bsonType", Value: "object"},
+	{Key: "required", Value: bson.A{"_id", "startTime", "endTime", "spans"}},
+	{Key: "properties", Value: bson.D{
+		{Key: "_id", Value: bson.D{{Key: "bsonType", Value: "string"}}},
+		{Key: "startTime", Value: bson.D{{Key: "bsonType", Value: "date"}}},
+		{Key: "endTime", Value: bson.D{{Key: "bsonType", Value: "date"}}},
+		{Key: "spans", Value: bson.D{
+			{Key: "bsonType", Value: "array"},
+			{Key: "items", Value: spanSchema},
+		}},
+	}},
+}
+
+// operationSchema is the JSON schema of catalog entries.
+var operationSchema = bson.D{
+	{Key: "bsonType", Value: "object"},
+	{Key: "required", Value: bson.A{"serviceName", "operationName", "spanKind", "lastSeen"}},
+	{Key: "properties", Value: bson.D{
+		{Key: "serviceName", Value: bson.D{{Key: "bsonType", Value: "string"}}},
+		{Key: "operationName", Value: bson.D{{Key: "bsonType", Value: "string"}}},
+		{Key: "spanKind", Value: bson.D{{Key: "bsonType", Value: "string"}}},
+		{Key: "lastSeen", Value: bson.D{{Key: "bsonType", Value: "date"}}},
+	}},
+}
+
+// dependenciesSchema is the JSON schema of rolled up Dependencies.
+var dependenciesSchema = bson.D{
+	{Key: "bsonType", Value: "object"},
+	{Key: "required", Value: bson.A{"_id", "endTime", "links"}},
+	{Key: "properties", Value: bson.D{
+		{Key: "_id", Value: bson.D{{Key: "bsonType", Value: "date"}}},
+		{Key: "endTime", Value: bson.D{{Key: "bsonType", Value: "date"}}},
+		{Key: "links", Value: bson.D{{Key: "bsonType", Value: "array"}}},
+	}},
+}
+
+// collectionSpec is a collection as created by Bootstrap.
+type collectionSpec struct {
+	name       string
+	indexes    []mongo.IndexModel
+	schema     bson.D
+	timeSeries bool
+}
+
+// collectionSpecs returns the collections of the configuration.
+func collectionSpecs(config Configuration, layout Layout, retention *Retention) []collectionSpec {
+	ttl := retention.Max()
+
+	spans := collectionSpec{name: config.MongoCollection}
+	switch layout {
+	case LayoutTrace:
+		spans.indexes, spans.schema = TraceIndexes(ttl), traceSchema
+	case LayoutTimeSeries:
+		// Time-series collections do not support schema validation.
+		spans.indexes, spans.timeSeries = TimeSeriesIndexes(), true
+	default:
+		spans.indexes, spans.schema = SpanIndexes(ttl), spanSchema
+	}
+	if retention.PerService() && !spans.timeSeries {
+		spans.indexes = append(spans.indexes, ExpireAtIndex())
+	}
+
+	specs := []collectionSpec{
+		spans,
+		{name: config.MongoArchiveCollection, indexes: ArchiveIndexes(), schema: spanSchema},
+	}
+	if config.MongoCatalogCollection != "" {
+		// Services are listed as long as any of their spans are kept.
+		specs = append(specs, collectionSpec{name: config.MongoCatalogCollection, indexes: CatalogIndexes(ttl), schema: operationSchema})
+	}
+	// Dependency links are kept as long as the spans they were rolled up from.
+	return append(specs, collectionSpec{name: config.MongoDependenciesCollection, indexes: DependenciesIndexes(ttl), schema: dependenciesSchema})
+}
+
+// Bootstrap creates the collections of the configuration in db with their
+// indexes, which expire documents as set by MongoSpanTTLDuration and
+// MongoServiceTTL, and with JSON schema validation if MongoSchemaValidation
+// is set. Existing collections and indexes are kept, except that indexes
+// whose keys changed are rebuilt and, if MongoApplyTTL is set, changed
+// retentions are applied, so Bootstrap can be run any number of times. It
+// returns a description of every change it made, and fails if an existing
+// index still differs from its expected definition.
+func Bootstrap(ctx context.Context, db *mongo.Database, config Configuration) ([]string, error) {
+	layout, err := ParseLayout(config.MongoLayout)
+	if err != nil {
+		return nil, err
+	}
+	retention, err := NewRetention(config.MongoSpanTTLDuration, config.MongoServiceTTL)
+	if err != nil {
+		return nil, err
+	}
+	if retention.PerService() && layout == LayoutTimeSeries {
+		return nil, ErrPerServiceTimeSeries
+	}
+
+	var changes []string
+	for _, spec := range collectionSpecs(config, layout, retention) {
+		namespace := db.Name() + "." + spec.name
+
+		if spec.timeSeries {
+			created, err := CreateTimeSeriesCollection(ctx, db, spec.name, config.MongoSpanTTLDuration)
+			if err != nil {
+				return changes, err
+			}
+			if created {
+				changes = append(changes, fmt.Sprintf("created time-series collection %s", namespace))
+			}
+			if config.MongoApplyTTL {
+				change, err := TimeSeriesTTLChange(ctx, db, spec.name, config.MongoSpanTTLDuration)
+				if err != nil {
+					return changes, err
+				}
+				if change != nil {
+					if err := UpdateTTL(ctx, db, *change); err != nil {
+						return changes, err
+					}
+					changes = append(changes, fmt.Sprintf("changed %s", change))
+				}
+			}
+		} else {
+			change, err := ensureCollection(ctx, db, spec, config.MongoSchemaValidation)
+			if err != nil {
+				return changes, err
+			}
+			if change != "" {
+				changes = append(changes, change)
+			}
+		}
+
+		collection := db.Collection(spec.name)
+		created, err := CreateIndexes(ctx, collection, spec.indexes)
+		if err != nil {
+			return changes, err
+		}
+		for _, name := range created {
+			changes = append(changes, fmt.Sprintf("created index %s on %s", name, namespace))
+		}
+		rebuilt, err := RebuildIndexes(ctx, collection, spec.indexes)
+		if err != nil {
+			return changes, err
+		}
+		for _, name := range rebuilt {
+			changes = append(changes, fmt.Sprintf("rebuilt index %s on %s", name, namespace))
+		}
+
+		diff, err := CompareIndexes(ctx, collection, spec.indexes)
+		if err != nil {
+			return changes, err
+		}
+		if config.MongoApplyTTL && len(diff.TTLChanges) != 0 {
+			for _, change := range diff.TTLChanges {
+				if err := UpdateTTL(ctx, db, change); err != nil {
+					return changes, err
+				}
+				changes = append(changes, fmt.Sprintf("changed %s", change))
+			}
+			if diff, err = CompareIndexes(ctx, collection, spec.indexes); err != nil {
+				return changes, err
+			}
+		}
+		if diff.Diverged() {
+			return changes, fmt.Errorf("indexes diverge: %s", diff)
+		}
+	}
+	return changes, nil
+}
+
+// ensureCollection creates the collection of spec if it does not exist, and
+// sets its schema validation if validate is set and the validator differs.
+// It returns the change it made, if any.
+func ensureCollection(ctx context.Context, db *mongo.Database, spec collectionSpec, validate bool) (string, error) {
+	namespace := db.Name() + "." + spec.name
+	info, err := getCollectionInfo(ctx, db, spec.name)
+	if err != nil {
+		return "", err
+	}
+
+	var validator bson.D
+	if validate {
+		validator = bson.D{{Key: "$jsonSchema", Value: spec.schema}}
+	}
+
+	if info == nil {
+		cmd := bson.D{{Key: "create", Value: spec.name}}
+		if validator != nil {
+			cmd = append(cmd, bson.E{Key: "validator", Value: validator})
+		}
+		if err := db.RunCommand(ctx, cmd).Err(); err != nil {
+			return "", fmt.Errorf("error creating collection %s: %w", spec.name, err)
+		}
+		if validator != nil {
+			return fmt.Sprintf("created collection %s with schema validation", namespace), nil
+		}
+		return fmt.Sprintf("created collection %s", namespace), nil
+	}
+
+	if validator == nil {
+		// A validator set by other means is kept.
+		return "", nil
+	}
+	same, err := sameValidator(info.Options["validator"], validator)
+	if err != nil {
+		return "", err
+	}
+	if same {
+		return "", nil
+	}
+	cmd := bson.D{
+		{Key: "collMod", Value: spec.name},
+		{Key: "validator", Value: validator},
+	}
+	if err := db.RunCommand(ctx, cmd).Err(); err != nil {
+		return "", fmt.Errorf("error setting schema validation of %s: %w", spec.name, err)
+	}
+	return fmt.Sprintf("set schema validation of %s", namespace), nil
+}
+
+// sameValidator reports whether the validator listed by the server is the
+// desired one.
+func sameValidator(existing interface{}, desired bson.D) (bool, error) {
+	if existing == nil {
+		return false, nil
+	}
+	b, err := bson.Marshal(desired)
+	if err != nil {
+		return false, err
+	}
+	var want bson.M
+	if err := bson.Unmarshal(b, &want); err != nil {
+		return false, err
+	}
+	b, err = bson.Marshal(existing)
+	if err != nil {
+		return false, err
+	}
+	var got bson.M
+	if err := bson.Unmarshal(b, &got); err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(got, want), nil
+}
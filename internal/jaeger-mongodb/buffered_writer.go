@@ -0,0 +1,196 @@
+package jaeger_mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrWriterClosed = errors.New("span writer is closed")
+
+// BufferedSpanWriter queues spans in memory and writes them to MongoDB in
+// batches from a background goroutine. A batch is flushed once it holds
+// batchSize spans or flushInterval has elapsed, whichever comes first.
+// WriteSpan blocks while the queue is full.
+type BufferedSpanWriter struct {
+	writer        *SpanWriter
+	log           hclog.Logger
+	batchSize     int
+	flushInterval time.Duration
+	flushTimeout  time.Duration
+
+	// mu guards closed and prevents the queue from being closed while
+	// WriteSpan is sending to it.
+	mu      sync.RWMutex
+	closed  bool
+	queue   chan Span
+	stopped chan struct{}
+}
+
+// NewBufferedSpanWriter starts a BufferedSpanWriter on top of writer holding
+// at most queueSize spans in memory. Each flush is bounded by flushTimeout.
+func NewBufferedSpanWriter(writer *SpanWriter, queueSize int, batchSize int, flushInterval time.Duration, flushTimeout time.Duration) (*BufferedSpanWriter, error) {
+	if queueSize <= 0 {
+		return nil, fmt.Errorf("invalid queue size %d, must be positive", queueSize)
+	}
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("invalid batch size %d, must be positive", batchSize)
+	}
+	if flushInterval <= 0 {
+		return nil, fmt.Errorf("invalid flush interval %s, must be positive", flushInterval)
+	}
+	logger := writer.log
+	if logger == nil {
+		logger = hclog.NewNullLogger()
+	}
+	b := &BufferedSpanWriter{
+		writer:        writer,
+		log:           logger,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		flushTimeout:  flushTimeout,
+		queue:         make(chan Span, queueSize),
+		stopped:       make(chan struct{}),
+	}
+	go b.run()
+	return b, nil
+}
+
+// WriteSpan queues the span to be written with the next batch.
+func (b *BufferedSpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	mSpan, err := b.writer.convertSpan(span)
+	if err != nil {
+		return err
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrWriterClosed
+	}
+	select {
+	case b.queue <- mSpan:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting spans and blocks until every queued span is flushed.
+func (b *BufferedSpanWriter) Close() error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+
+	<-b.stopped
+	return nil
+}
+
+func (b *BufferedSpanWriter) run() {
+	defer close(b.stopped)
+
+	ticker := time.NewTicker(b.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Span, 0, b.batchSize)
+	for {
+		select {
+		case mSpan, ok := <-b.queue:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			batch = append(batch, mSpan)
+			if len(batch) >= b.batchSize {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			b.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush writes the batch, then records the operations of the spans written
+// in the catalog.
+func (b *BufferedSpanWriter) flush(batch []Span) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.flushTimeout)
+	defer cancel()
+
+	written := b.write(ctx, batch)
+	if b.writer.catalog == nil || len(written) == 0 {
+		return
+	}
+	if err := b.writer.catalog.recordAll(ctx, written); err != nil {
+		// The spans are stored, so only the catalog falls behind until
+		// the operations are seen again.
+		b.log.Error("error recording operations in catalog", "spans", len(written), "err", err)
+	}
+}
+
+// write writes the batch and returns the spans that are stored.
+func (b *BufferedSpanWriter) write(ctx context.Context, batch []Span) []Span {
+	models := make([]mongo.WriteModel, len(batch))
+	for i := range batch {
+		models[i] = b.writer.writeModel(&batch[i])
+	}
+	// Unordered so that one failing span does not prevent the rest of the
+	// batch from being written.
+	opts := options.BulkWrite().SetOrdered(false)
+	_, err := b.writer.collection.BulkWrite(ctx, models, opts)
+	if err == nil {
+		return batch
+	}
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+		b.log.Error("error writing span batch", "spans", len(batch), "err", err)
+		return nil
+	}
+	failed := make(map[int]struct{})
+	for _, we := range bwe.WriteErrors {
+		if !isDuplicateKeyWriteError(we) {
+			failed[we.Index] = struct{}{}
+			continue
+		}
+		// Spans that were already written are not failures. In the trace
+		// layout the trace document may also have been inserted by another
+		// span of the batch, so write the span again.
+		if b.writer.layout == LayoutTrace {
+			if err := b.writer.writeTraceSpan(ctx, &batch[we.Index]); err != nil {
+				failed[we.Index] = struct{}{}
+			}
+		}
+	}
+	if len(failed) == 0 {
+		return batch
+	}
+	b.log.Error("error writing span batch", "spans", len(batch), "failed", len(failed), "err", err)
+	written := make([]Span, 0, len(batch)-len(failed))
+	for i := range batch {
+		if _, ok := failed[i]; !ok {
+			written = append(written, batch[i])
+		}
+	}
+	return written
+}
+
+// isDuplicateKeyWriteError reports whether a single write of a bulk write
+// failed with a duplicate key error. The driver only classifies whole
+// exceptions, so the write error is wrapped in one.
+func isDuplicateKeyWriteError(we mongo.BulkWriteError) bool {
+	return mongo.IsDuplicateKeyError(mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{we}})
+}
@@ -0,0 +1,155 @@
+package jaeger_mongodb
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// catalogRefreshInterval is how often the lastSeen timestamp of a catalog
+// entry is updated. Entries therefore expire at most this much later than
+// the last span they were recorded for.
+const catalogRefreshInterval = time.Hour
+
+// Operation is an entry of the catalog of service and operation names, which
+// answers GetServices and GetOperations without scanning the spans.
+type Operation struct {
+	ServiceName   string    `bson:"serviceName"`
+	OperationName string    `bson:"operationName"`
+	SpanKind      string    `bson:"spanKind"`
+	LastSeen      time.Time `bson:"lastSeen"`
+}
+
+// operationCatalog records the operations of written spans in the catalog
+// collection. Each operation is written at most once per
+// catalogRefreshInterval.
+type operationCatalog struct {
+	collection *mongo.Collection
+
+	mu       sync.Mutex
+	lastSeen map[Operation]time.Time
+}
+
+func newOperationCatalog(collection *mongo.Collection) *operationCatalog {
+	return &operationCatalog{
+		collection: collection,
+		lastSeen:   make(map[Operation]time.Time),
+	}
+}
+
+// record upserts the operation of the span unless it was recorded recently.
+func (c *operationCatalog) record(ctx context.Context, mSpan *Span) error {
+	key := operationKey(mSpan)
+	if !c.due(key, mSpan.StartTime) {
+		return nil
+	}
+	_, err := c.collection.UpdateOne(ctx, operationFilter(key), lastSeenUpdate(mSpan.StartTime), options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// A concurrent upsert inserted the entry first.
+		return nil
+	}
+	if err != nil {
+		c.forget(key, mSpan.StartTime)
+	}
+	return err
+}
+
+// recordAll records the operations of the spans like record, with a single
+// bulk write for all operations that are due.
+func (c *operationCatalog) recordAll(ctx context.Context, spans []Span) error {
+	latest := make(map[Operation]time.Time)
+	for i := range spans {
+		key := operationKey(&spans[i])
+		if t, ok := latest[key]; !ok || spans[i].StartTime.After(t) {
+			latest[key] = spans[i].StartTime
+		}
+	}
+
+	var keys []Operation
+	var models []mongo.WriteModel
+	for key, startTime := range latest {
+		if !c.due(key, startTime) {
+			continue
+		}
+		keys = append(keys, key)
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(operationFilter(key)).
+			SetUpdate(lastSeenUpdate(startTime)).
+			SetUpsert(true))
+	}
+	if len(models) == 0 {
+		return nil
+	}
+
+	_, err := c.collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err == nil {
+		return nil
+	}
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+		for _, key := range keys {
+			c.forget(key, latest[key])
+		}
+		return err
+	}
+	failed := 0
+	for _, we := range bwe.WriteErrors {
+		if isDuplicateKeyWriteError(we) {
+			// A concurrent upsert inserted the entry first.
+			continue
+		}
+		failed++
+		c.forget(keys[we.Index], latest[keys[we.Index]])
+	}
+	if failed == 0 {
+		return nil
+	}
+	return err
+}
+
+// due reports whether the operation must be written for a span started at
+// startTime, and if so marks it as recorded.
+func (c *operationCatalog) due(key Operation, startTime time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lastSeen, ok := c.lastSeen[key]
+	if ok && startTime.Before(lastSeen.Add(catalogRefreshInterval)) {
+		return false
+	}
+	c.lastSeen[key] = startTime
+	return true
+}
+
+// forget lets the next span of the operation try again after a failed write.
+func (c *operationCatalog) forget(key Operation, startTime time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastSeen[key].Equal(startTime) {
+		delete(c.lastSeen, key)
+	}
+}
+
+func operationKey(mSpan *Span) Operation {
+	return Operation{
+		ServiceName:   mSpan.Process.ServiceName,
+		OperationName: mSpan.OperationName,
+		SpanKind:      mSpan.SpanKind,
+	}
+}
+
+func operationFilter(key Operation) bson.D {
+	return bson.D{
+		{Key: "serviceName", Value: key.ServiceName},
+		{Key: "operationName", Value: key.OperationName},
+		{Key: "spanKind", Value: key.SpanKind},
+	}
+}
+
+func lastSeenUpdate(startTime time.Time) bson.D {
+	return bson.D{{Key: "$max", Value: bson.D{{Key: "lastSeen", Value: startTime}}}}
+}
@@ -0,0 +1,108 @@
+package jaeger_mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// namespaceExistsCode is the server error code of creating a collection that
+// already exists.
+const namespaceExistsCode = 48
+
+// collectionInfo is a collection as listed by the server.
+type collectionInfo struct {
+	Name    string `bson:"name"`
+	Type    string `bson:"type"`
+	Options bson.M `bson:"options"`
+}
+
+// getCollectionInfo returns the listing of the named collection, or nil if it
+// does not exist.
+func getCollectionInfo(ctx context.Context, db *mongo.Database, name string) (*collectionInfo, error) {
+	cursor, err := db.ListCollections(ctx, bson.D{{Key: "name", Value: name}})
+	if err != nil {
+		return nil, fmt.Errorf("error listing collection %s: %w", name, err)
+	}
+	defer cursor.Close(ctx)
+	if !cursor.Next(ctx) {
+		if err := cursor.Err(); err != nil {
+			return nil, fmt.Errorf("error listing collection %s: %w", name, err)
+		}
+		return nil, nil
+	}
+	var info collectionInfo
+	if err := cursor.Decode(&info); err != nil {
+		return nil, fmt.Errorf("error decoding collection %s: %w", name, err)
+	}
+	return &info, nil
+}
+
+// CreateTimeSeriesCollection creates the named spans collection of the
+// time-series layout, which requires MongoDB 6.0, unless it already exists.
+// startTime is the time field and process the meta field, so spans are
+// bucketed by service and process tags. Spans expire ttl after they started.
+// It reports whether the collection was created, and fails if a collection
+// that is not a time-series collection already has the name.
+func CreateTimeSeriesCollection(ctx context.Context, db *mongo.Database, name string, ttl time.Duration) (bool, error) {
+	opts := options.CreateCollection().
+		SetTimeSeriesOptions(options.TimeSeries().
+			SetTimeField("startTime").
+			SetMetaField("process").
+			SetGranularity("seconds")).
+		SetExpireAfterSeconds(int64(ttl.Seconds()))
+	err := db.CreateCollection(ctx, name, opts)
+	if err == nil {
+		return true, nil
+	}
+	var cmdErr mongo.CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Code != namespaceExistsCode {
+		return false, fmt.Errorf("error creating time-series collection %s: %w", name, err)
+	}
+
+	info, err := getCollectionInfo(ctx, db, name)
+	if err != nil {
+		return false, err
+	}
+	if info != nil && info.Type != "timeseries" {
+		return false, fmt.Errorf("collection %s exists and is not a time-series collection", name)
+	}
+	return false, nil
+}
+
+// TimeSeriesTTLChange returns the change of the expiry of the named
+// time-series collection to ttl, or nil if it already expires documents after
+// ttl.
+func TimeSeriesTTLChange(ctx context.Context, db *mongo.Database, name string, ttl time.Duration) (*TTLChange, error) {
+	info, err := getCollectionInfo(ctx, db, name)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil || info.Type != "timeseries" {
+		return nil, fmt.Errorf("collection %s is not a time-series collection", name)
+	}
+
+	var seconds int64
+	switch v := info.Options["expireAfterSeconds"].(type) {
+	case int32:
+		seconds = int64(v)
+	case int64:
+		seconds = v
+	case float64:
+		seconds = int64(v)
+	}
+	change := TTLChange{
+		Collection: name,
+		Old:        time.Duration(seconds) * time.Second,
+		New:        time.Duration(int64(ttl.Seconds())) * time.Second,
+	}
+	if change.Old == change.New {
+		return nil, nil
+	}
+	return &change, nil
+}
@@ -8,23 +8,57 @@ import (
 )
 
 const (
-	mongoUrl             = "mongo_url"
-	mongoDatabase        = "mongo_database"
-	mongoCollection      = "mongo_collection"
-	mongoTimeoutDuration = "mongo_timeout_duration"
-	mongoSpanTTLDuration = "mongo_span_ttl_duration"
-	otelTracingRatio     = "otel_tracing_ratio"
-	otelExporterEndpoint = "otel_exporter_endpoint"
+	mongoUrl                    = "mongo_url"
+	mongoDatabase               = "mongo_database"
+	mongoCollection             = "mongo_collection"
+	mongoArchiveCollection      = "mongo_archive_collection"
+	mongoCatalogCollection      = "mongo_catalog_collection"
+	mongoDependenciesCollection = "mongo_dependencies_collection"
+	mongoMigrationsCollection   = "mongo_migrations_collection"
+	mongoDependenciesInterval   = "mongo_dependencies_interval"
+	mongoDependenciesDelay      = "mongo_dependencies_delay"
+	mongoTimeoutDuration        = "mongo_timeout_duration"
+	mongoSpanTTLDuration        = "mongo_span_ttl_duration"
+	mongoServiceTTL             = "mongo_service_ttl"
+	mongoMaxBinarySize          = "mongo_max_binary_value_size"
+	mongoWriterQueueSize        = "mongo_writer_queue_size"
+	mongoWriterBatchSize        = "mongo_writer_batch_size"
+	mongoWriterFlushInterval    = "mongo_writer_flush_interval"
+	mongoTagMatch               = "mongo_tag_match"
+	mongoVerifyIndexes          = "mongo_verify_indexes"
+	mongoApplyTTL               = "mongo_apply_ttl"
+	mongoLayout                 = "mongo_layout"
+	mongoBootstrap              = "mongo_bootstrap"
+	mongoSchemaValidation       = "mongo_schema_validation"
+	otelTracingRatio            = "otel_tracing_ratio"
+	otelExporterEndpoint        = "otel_exporter_endpoint"
 )
 
 type Configuration struct {
-	MongoUrl             string        `yaml:"mongo_url"`
-	MongoDatabase        string        `yaml:"mongo_database"`
-	MongoCollection      string        `yaml:"mongo_collection"`
-	MongoTimeoutDuration time.Duration `yaml:"mongo_timeout_duration"`
-	MongoSpanTTLDuration time.Duration `yaml:"mongo_span_ttl_duration"`
-	OtelTracingRatio     float64       `yaml:"otel_tracing_ratio"`
-	OtelExporterEndpoint string        `yaml:"otel_exporter_endpoint"`
+	MongoUrl                    string            `yaml:"mongo_url"`
+	MongoDatabase               string            `yaml:"mongo_database"`
+	MongoCollection             string            `yaml:"mongo_collection"`
+	MongoArchiveCollection      string            `yaml:"mongo_archive_collection"`
+	MongoCatalogCollection      string            `yaml:"mongo_catalog_collection"`
+	MongoDependenciesCollection string            `yaml:"mongo_dependencies_collection"`
+	MongoMigrationsCollection   string            `yaml:"mongo_migrations_collection"`
+	MongoDependenciesInterval   time.Duration     `yaml:"mongo_dependencies_interval"`
+	MongoDependenciesDelay      time.Duration     `yaml:"mongo_dependencies_delay"`
+	MongoTimeoutDuration        time.Duration     `yaml:"mongo_timeout_duration"`
+	MongoSpanTTLDuration        time.Duration     `yaml:"mongo_span_ttl_duration"`
+	MongoServiceTTL             map[string]string `yaml:"mongo_service_ttl"`
+	MongoMaxBinarySize          int               `yaml:"mongo_max_binary_value_size"`
+	MongoWriterQueueSize        int               `yaml:"mongo_writer_queue_size"`
+	MongoWriterBatchSize        int               `yaml:"mongo_writer_batch_size"`
+	MongoWriterFlushInterval    time.Duration     `yaml:"mongo_writer_flush_interval"`
+	MongoTagMatch               string            `yaml:"mongo_tag_match"`
+	MongoVerifyIndexes          bool              `yaml:"mongo_verify_indexes"`
+	MongoApplyTTL               bool              `yaml:"mongo_apply_ttl"`
+	MongoLayout                 string            `yaml:"mongo_layout"`
+	MongoBootstrap              bool              `yaml:"mongo_bootstrap"`
+	MongoSchemaValidation       bool              `yaml:"mongo_schema_validation"`
+	OtelTracingRatio            float64           `yaml:"otel_tracing_ratio"`
+	OtelExporterEndpoint        string            `yaml:"otel_exporter_endpoint"`
 }
 
 // Options stores the configuration entries for this storage
@@ -43,16 +77,49 @@ func (opt *Options) InitFromViper(v *viper.Viper) {
 	v.SetDefault(mongoUrl, "mongodb://localhost:27017")
 	v.SetDefault(mongoDatabase, "traces")
 	v.SetDefault(mongoCollection, "spans")
+	v.SetDefault(mongoArchiveCollection, "archive")
+	v.SetDefault(mongoCatalogCollection, "") // services and operations are read from the spans by default
+	v.SetDefault(mongoDependenciesCollection, "dependencies")
+	v.SetDefault(mongoMigrationsCollection, "migrations")
+	v.SetDefault(mongoDependenciesInterval, 0) // links are computed from spans by default
+	v.SetDefault(mongoDependenciesDelay, "5m")
 	v.SetDefault(mongoTimeoutDuration, "5s")
 	v.SetDefault(mongoSpanTTLDuration, "336h")
+	v.SetDefault(mongoMaxBinarySize, 4096)
+	v.SetDefault(mongoWriterQueueSize, 0) // spans are written synchronously by default
+	v.SetDefault(mongoWriterBatchSize, 1000)
+	v.SetDefault(mongoWriterFlushInterval, "1s")
+	v.SetDefault(mongoTagMatch, "span")
+	v.SetDefault(mongoVerifyIndexes, false)
+	v.SetDefault(mongoApplyTTL, false)
+	v.SetDefault(mongoLayout, "span")
+	v.SetDefault(mongoBootstrap, true)
+	v.SetDefault(mongoSchemaValidation, false)
 	v.SetDefault(otelTracingRatio, 0.0) // tracing is disabled by default
 	v.SetDefault(otelExporterEndpoint, "http://localhost:14268/api/traces")
 
 	opt.Configuration.MongoUrl = v.GetString(mongoUrl)
 	opt.Configuration.MongoDatabase = v.GetString(mongoDatabase)
 	opt.Configuration.MongoCollection = v.GetString(mongoCollection)
+	opt.Configuration.MongoArchiveCollection = v.GetString(mongoArchiveCollection)
+	opt.Configuration.MongoCatalogCollection = v.GetString(mongoCatalogCollection)
+	opt.Configuration.MongoDependenciesCollection = v.GetString(mongoDependenciesCollection)
+	opt.Configuration.MongoMigrationsCollection = v.GetString(mongoMigrationsCollection)
+	opt.Configuration.MongoDependenciesInterval = v.GetDuration(mongoDependenciesInterval)
+	opt.Configuration.MongoDependenciesDelay = v.GetDuration(mongoDependenciesDelay)
 	opt.Configuration.MongoTimeoutDuration = v.GetDuration(mongoTimeoutDuration)
 	opt.Configuration.MongoSpanTTLDuration = v.GetDuration(mongoSpanTTLDuration)
+	opt.Configuration.MongoServiceTTL = v.GetStringMapString(mongoServiceTTL)
+	opt.Configuration.MongoMaxBinarySize = v.GetInt(mongoMaxBinarySize)
+	opt.Configuration.MongoWriterQueueSize = v.GetInt(mongoWriterQueueSize)
+	opt.Configuration.MongoWriterBatchSize = v.GetInt(mongoWriterBatchSize)
+	opt.Configuration.MongoWriterFlushInterval = v.GetDuration(mongoWriterFlushInterval)
+	opt.Configuration.MongoTagMatch = v.GetString(mongoTagMatch)
+	opt.Configuration.MongoVerifyIndexes = v.GetBool(mongoVerifyIndexes)
+	opt.Configuration.MongoApplyTTL = v.GetBool(mongoApplyTTL)
+	opt.Configuration.MongoLayout = v.GetString(mongoLayout)
+	opt.Configuration.MongoBootstrap = v.GetBool(mongoBootstrap)
+	opt.Configuration.MongoSchemaValidation = v.GetBool(mongoSchemaValidation)
 	opt.Configuration.OtelTracingRatio = v.GetFloat64(otelTracingRatio)
 	opt.Configuration.OtelExporterEndpoint = v.GetString(otelExporterEndpoint)
 }
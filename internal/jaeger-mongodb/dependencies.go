@@ -0,0 +1,148 @@
+package jaeger_mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Dependencies is the MongoDB representation of the dependency links of all
+// spans started within one rollup interval.
+type Dependencies struct {
+	StartTime time.Time    `bson:"_id"`
+	EndTime   time.Time    `bson:"endTime"`
+	Links     []Dependency `bson:"links"`
+}
+
+// Dependency is the number of calls from the parent to the child service.
+type Dependency struct {
+	Parent    string `bson:"parent"`
+	Child     string `bson:"child"`
+	CallCount int64  `bson:"callCount"`
+}
+
+// DependenciesRollup periodically computes the dependency links of the spans
+// collection and stores them in the dependencies collection, one document per
+// interval, so that GetDependencies does not have to scan spans.
+type DependenciesRollup struct {
+	spans        *mongo.Collection
+	dependencies *mongo.Collection
+	log          hclog.Logger
+	interval     time.Duration
+	// delay is how long to wait after an interval ends before rolling it
+	// up, leaving late spans time to be written.
+	delay time.Duration
+	// retention bounds how far back missing intervals are rolled up.
+	retention time.Duration
+	timeout   time.Duration
+	layout    Layout
+}
+
+func NewDependenciesRollup(spans *mongo.Collection, dependencies *mongo.Collection, logger hclog.Logger, interval time.Duration, delay time.Duration, retention time.Duration, timeout time.Duration) *DependenciesRollup {
+	if logger == nil {
+		logger = hclog.NewNullLogger()
+	}
+	return &DependenciesRollup{
+		spans:        spans,
+		dependencies: dependencies,
+		log:          logger,
+		interval:     interval,
+		delay:        delay,
+		retention:    retention,
+		timeout:      timeout,
+		layout:       LayoutSpan,
+	}
+}
+
+// WithLayout sets the Layout of the spans collection.
+func (r *DependenciesRollup) WithLayout(layout Layout) *DependenciesRollup {
+	r.layout = layout
+	return r
+}
+
+// Run rolls up pending intervals every interval until ctx is cancelled.
+func (r *DependenciesRollup) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		if err := r.RollupPending(ctx, time.Now()); err != nil {
+			r.log.Error("error rolling up dependency links", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RollupPending rolls up every interval that ended at least delay before now
+// and has not been rolled up yet.
+func (r *DependenciesRollup) RollupPending(ctx context.Context, now time.Time) error {
+	end := now.Add(-r.delay).Truncate(r.interval)
+	start := end.Add(-r.retention).Truncate(r.interval)
+
+	var last Dependencies
+	err := r.dependencies.FindOne(ctx, bson.D{}, options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})).Decode(&last)
+	switch {
+	case err == nil:
+		if last.EndTime.After(start) {
+			start = last.EndTime
+		}
+	case !errors.Is(err, mongo.ErrNoDocuments):
+		return fmt.Errorf("error finding last rolled up interval: %w", err)
+	}
+
+	for ; !start.Add(r.interval).After(end); start = start.Add(r.interval) {
+		if err := r.Rollup(ctx, start, start.Add(r.interval)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollup computes the dependency links of the spans started in [start, end)
+// and stores them, replacing any links previously stored for the interval.
+func (r *DependenciesRollup) Rollup(ctx context.Context, start, end time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	opts := options.Aggregate().SetAllowDiskUse(true)
+	cursor, err := r.spans.Aggregate(ctx, linksPipeline(r.layout, r.spans.Name(), start, end), opts)
+	if err != nil {
+		return fmt.Errorf("error aggregating dependency links: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	deps := Dependencies{
+		StartTime: start,
+		EndTime:   end,
+		Links:     []Dependency{},
+	}
+	for cursor.Next(ctx) {
+		var link dependencyLink
+		if err := cursor.Decode(&link); err != nil {
+			return fmt.Errorf("error decoding dependency link: %w", err)
+		}
+		deps.Links = append(deps.Links, Dependency{
+			Parent:    link.ID.Parent,
+			Child:     link.ID.Child,
+			CallCount: link.CallCount,
+		})
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("error aggregating dependency links: %w", err)
+	}
+
+	_, err = r.dependencies.ReplaceOne(ctx, bson.D{{Key: "_id", Value: start}}, deps, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("error storing dependency links: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,425 @@
+package jaeger_mongodb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// SpanIndexes returns the indexes of the spans collection. Spans expire ttl
+// after they started.
+func SpanIndexes(ttl time.Duration) []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "startTime", Value: 1}},
+			Options: options.Index().
+				SetName("TTLIndex").
+				SetExpireAfterSeconds(int32(ttl.Seconds())),
+		},
+		{
+			Keys: bson.D{
+				{Key: "process.serviceName", Value: 1},
+				{Key: "operationName", Value: 1},
+				{Key: "startTime", Value: -1},
+			},
+			Options: options.Index().SetName("ServiceNameAndOperationsIndex"),
+		},
+		// No unique index is needed to reject duplicate spans: span documents
+		// have a deterministic _id and the _id index is always unique.
+		{
+			Keys:    bson.D{{Key: "traceID", Value: 1}},
+			Options: options.Index().SetName("TraceIDIndex"),
+		},
+		{
+			Keys: bson.D{
+				{Key: "process.serviceName", Value: 1},
+				{Key: "operationName", Value: 1},
+				{Key: "tags.key", Value: 1},
+				{Key: "tags.value", Value: 1},
+				{Key: "startTime", Value: -1},
+			},
+			Options: options.Index().SetName("TagsIndex"),
+		},
+		// Query tags are also matched against process tags and log fields.
+		{
+			Keys: bson.D{
+				{Key: "process.serviceName", Value: 1},
+				{Key: "process.tags.key", Value: 1},
+				{Key: "process.tags.value", Value: 1},
+				{Key: "startTime", Value: -1},
+			},
+			Options: options.Index().SetName("ProcessTagsIndex"),
+		},
+		{
+			Keys: bson.D{
+				{Key: "process.serviceName", Value: 1},
+				{Key: "logs.fields.key", Value: 1},
+				{Key: "logs.fields.value", Value: 1},
+				{Key: "startTime", Value: -1},
+			},
+			Options: options.Index().SetName("LogFieldsIndex"),
+		},
+		// Supports FindTraces queries by service with a duration range.
+		{
+			Keys: bson.D{
+				{Key: "process.serviceName", Value: 1},
+				{Key: "duration", Value: 1},
+				{Key: "startTime", Value: -1},
+			},
+			Options: options.Index().SetName("ServiceNameAndDurationIndex"),
+		},
+	}
+}
+
+// TraceIndexes returns the indexes of the spans collection in the trace
+// layout. Trace documents expire ttl after their first span started.
+func TraceIndexes(ttl time.Duration) []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "startTime", Value: 1}},
+			Options: options.Index().
+				SetName("TTLIndex").
+				SetExpireAfterSeconds(int32(ttl.Seconds())),
+		},
+		{
+			Keys: bson.D{
+				{Key: "spans.process.serviceName", Value: 1},
+				{Key: "spans.operationName", Value: 1},
+				{Key: "startTime", Value: -1},
+			},
+			Options: options.Index().SetName("ServiceNameAndOperationsIndex"),
+		},
+		{
+			Keys: bson.D{
+				{Key: "spans.tags.key", Value: 1},
+				{Key: "spans.tags.value", Value: 1},
+			},
+			Options: options.Index().SetName("TagsIndex"),
+		},
+		{
+			Keys: bson.D{
+				{Key: "spans.process.serviceName", Value: 1},
+				{Key: "spans.duration", Value: 1},
+			},
+			Options: options.Index().SetName("ServiceNameAndDurationIndex"),
+		},
+		{
+			Keys: bson.D{
+				{Key: "rootService", Value: 1},
+				{Key: "startTime", Value: -1},
+			},
+			Options: options.Index().SetName("RootServiceIndex"),
+		},
+	}
+}
+
+// TimeSeriesIndexes returns the indexes of the spans collection in the
+// time-series layout. Time-series collections expire documents themselves
+// and do not support multikey indexes on measurements, so there is neither a
+// TTL nor a tags index. Indexes on measurements such as traceID require
+// MongoDB 6.0.
+func TimeSeriesIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "traceID", Value: 1}},
+			Options: options.Index().SetName("TraceIDIndex"),
+		},
+		{
+			Keys: bson.D{
+				{Key: "process.serviceName", Value: 1},
+				{Key: "operationName", Value: 1},
+				{Key: "startTime", Value: -1},
+			},
+			Options: options.Index().SetName("ServiceNameAndOperationsIndex"),
+		},
+		{
+			Keys: bson.D{
+				{Key: "process.serviceName", Value: 1},
+				{Key: "duration", Value: 1},
+				{Key: "startTime", Value: -1},
+			},
+			Options: options.Index().SetName("ServiceNameAndDurationIndex"),
+		},
+	}
+}
+
+// ArchiveIndexes returns the indexes of the archive collection. Archived
+// traces are kept until deleted, so unlike the spans collection it has no TTL
+// index.
+func ArchiveIndexes() []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{Key: "traceID", Value: 1},
+				{Key: "spanID", Value: 1},
+			},
+			Options: options.Index().
+				SetName("TraceIDAndSpanIDIndex").
+				SetUnique(true),
+		},
+	}
+}
+
+// CatalogIndexes returns the indexes of the services and operations catalog.
+// Catalog entries expire ttl after the last span recorded for them.
+func CatalogIndexes(ttl time.Duration) []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "lastSeen", Value: 1}},
+			Options: options.Index().
+				SetName("TTLIndex").
+				SetExpireAfterSeconds(int32(ttl.Seconds())),
+		},
+		{
+			Keys: bson.D{
+				{Key: "serviceName", Value: 1},
+				{Key: "operationName", Value: 1},
+				{Key: "spanKind", Value: 1},
+			},
+			Options: options.Index().
+				SetName("OperationIndex").
+				SetUnique(true),
+		},
+	}
+}
+
+// DependenciesIndexes returns the indexes of the dependencies collection.
+// Rolled up links expire together with the spans they were computed from.
+func DependenciesIndexes(ttl time.Duration) []mongo.IndexModel {
+	return []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "endTime", Value: 1}},
+			Options: options.Index().
+				SetName("TTLIndex").
+				SetExpireAfterSeconds(int32(ttl.Seconds())),
+		},
+	}
+}
+
+// IndexDiff describes how the indexes of a collection diverge from the
+// desired set, by index name.
+type IndexDiff struct {
+	Collection string
+	// Missing indexes do not exist.
+	Missing []string
+	// Changed indexes exist with different keys or options.
+	Changed []string
+	// Unexpected indexes exist but are not part of the desired set. They do
+	// not make the indexes diverge.
+	Unexpected []string
+	// TTLChanges are the changed TTL indexes whose only difference is their
+	// expiry, which UpdateTTL applies.
+	TTLChanges []TTLChange
+	// Rebuild are the changed indexes whose keys differ, which
+	// RebuildIndexes drops and creates again.
+	Rebuild []string
+}
+
+// Diverged reports whether a desired index is missing or changed.
+func (d IndexDiff) Diverged() bool {
+	return len(d.Missing) != 0 || len(d.Changed) != 0
+}
+
+func (d IndexDiff) String() string {
+	return fmt.Sprintf("collection %s: missing indexes [%s], changed indexes [%s], unexpected indexes [%s]",
+		d.Collection, strings.Join(d.Missing, ", "), strings.Join(d.Changed, ", "), strings.Join(d.Unexpected, ", "))
+}
+
+// indexSpec is an index as listed by the server.
+type indexSpec struct {
+	Name               string `bson:"name"`
+	Key                bson.D `bson:"key"`
+	Unique             bool   `bson:"unique"`
+	ExpireAfterSeconds *int64 `bson:"expireAfterSeconds"`
+}
+
+// CompareIndexes compares the existing indexes of the collection with the
+// desired indexes, which must all be named.
+func CompareIndexes(ctx context.Context, collection *mongo.Collection, indexes []mongo.IndexModel) (IndexDiff, error) {
+	diff := IndexDiff{Collection: collection.Name()}
+
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		return diff, fmt.Errorf("error listing indexes of %s: %w", collection.Name(), err)
+	}
+	var list []indexSpec
+	if err := cursor.All(ctx, &list); err != nil {
+		return diff, fmt.Errorf("error listing indexes of %s: %w", collection.Name(), err)
+	}
+	existing := make(map[string]indexSpec, len(list))
+	for _, spec := range list {
+		existing[spec.Name] = spec
+	}
+
+	desired := make(map[string]struct{}, len(indexes))
+	for _, index := range indexes {
+		want, err := desiredIndexSpec(index)
+		if err != nil {
+			return diff, err
+		}
+		desired[want.Name] = struct{}{}
+
+		got, ok := existing[want.Name]
+		switch {
+		case !ok:
+			diff.Missing = append(diff.Missing, want.Name)
+		case !sameKeys(got.Key, want.Key):
+			diff.Changed = append(diff.Changed, want.Name)
+			diff.Rebuild = append(diff.Rebuild, want.Name)
+		case got.Unique != want.Unique:
+			diff.Changed = append(diff.Changed, want.Name)
+		case !sameExpiry(got.ExpireAfterSeconds, want.ExpireAfterSeconds):
+			diff.Changed = append(diff.Changed, want.Name)
+			if got.ExpireAfterSeconds != nil && want.ExpireAfterSeconds != nil {
+				diff.TTLChanges = append(diff.TTLChanges, TTLChange{
+					Collection: collection.Name(),
+					Index:      want.Name,
+					Old:        time.Duration(*got.ExpireAfterSeconds) * time.Second,
+					New:        time.Duration(*want.ExpireAfterSeconds) * time.Second,
+				})
+			}
+		}
+	}
+	for _, spec := range list {
+		if _, ok := desired[spec.Name]; !ok && spec.Name != "_id_" {
+			diff.Unexpected = append(diff.Unexpected, spec.Name)
+		}
+	}
+	return diff, nil
+}
+
+// CreateIndexes creates the missing indexes of the collection and returns
+// their names. Indexes whose keys or options changed are left as they are,
+// see RebuildIndexes and UpdateTTL.
+func CreateIndexes(ctx context.Context, collection *mongo.Collection, indexes []mongo.IndexModel) ([]string, error) {
+	diff, err := CompareIndexes(ctx, collection, indexes)
+	if err != nil {
+		return nil, err
+	}
+	if err := createIndexes(ctx, collection, indexes, diff.Missing); err != nil {
+		return nil, err
+	}
+	return diff.Missing, nil
+}
+
+// RebuildIndexes drops the indexes of the collection whose keys changed, such
+// as TagsIndex before the case of its service name field was fixed, creates
+// them again and returns their names. Rebuilding an index of a large
+// collection takes a while, so only the init subcommand does it.
+func RebuildIndexes(ctx context.Context, collection *mongo.Collection, indexes []mongo.IndexModel) ([]string, error) {
+	diff, err := CompareIndexes(ctx, collection, indexes)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range diff.Rebuild {
+		if _, err := collection.Indexes().DropOne(ctx, name); err != nil {
+			return nil, fmt.Errorf("error dropping index %s of %s: %w", name, collection.Name(), err)
+		}
+	}
+	if err := createIndexes(ctx, collection, indexes, diff.Rebuild); err != nil {
+		return nil, err
+	}
+	return diff.Rebuild, nil
+}
+
+// createIndexes creates the named indexes of the collection.
+func createIndexes(ctx context.Context, collection *mongo.Collection, indexes []mongo.IndexModel, names []string) error {
+	var models []mongo.IndexModel
+	for _, index := range indexes {
+		for _, name := range names {
+			if *index.Options.Name == name {
+				models = append(models, index)
+			}
+		}
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	if _, err := collection.Indexes().CreateMany(ctx, models); err != nil {
+		return fmt.Errorf("error creating indexes of %s: %w", collection.Name(), err)
+	}
+	return nil
+}
+
+// TTLChange is a change of the retention of a collection, either of the
+// expiry of a TTL index or, if Index is empty, of a time-series collection.
+type TTLChange struct {
+	Collection string
+	Index      string
+	Old        time.Duration
+	New        time.Duration
+}
+
+func (c TTLChange) String() string {
+	if c.Index == "" {
+		return fmt.Sprintf("retention of collection %s from %s to %s", c.Collection, c.Old, c.New)
+	}
+	return fmt.Sprintf("retention of index %s of %s from %s to %s", c.Index, c.Collection, c.Old, c.New)
+}
+
+// UpdateTTL applies the change with collMod. Documents then expire
+// according to the new retention, without rebuilding any index.
+func UpdateTTL(ctx context.Context, db *mongo.Database, change TTLChange) error {
+	cmd := bson.D{{Key: "collMod", Value: change.Collection}}
+	if change.Index == "" {
+		cmd = append(cmd, bson.E{Key: "expireAfterSeconds", Value: int64(change.New.Seconds())})
+	} else {
+		cmd = append(cmd, bson.E{Key: "index", Value: bson.D{
+			{Key: "name", Value: change.Index},
+			{Key: "expireAfterSeconds", Value: int64(change.New.Seconds())},
+		}})
+	}
+	if err := db.RunCommand(ctx, cmd).Err(); err != nil {
+		return fmt.Errorf("error changing %s: %w", change, err)
+	}
+	return nil
+}
+
+func desiredIndexSpec(index mongo.IndexModel) (indexSpec, error) {
+	if index.Options == nil || index.Options.Name == nil {
+		return indexSpec{}, fmt.Errorf("index %v has no name", index.Keys)
+	}
+	spec := indexSpec{Name: *index.Options.Name}
+
+	b, err := bson.Marshal(index.Keys)
+	if err != nil {
+		return spec, fmt.Errorf("invalid keys of index %s: %w", spec.Name, err)
+	}
+	if err := bson.Unmarshal(b, &spec.Key); err != nil {
+		return spec, fmt.Errorf("invalid keys of index %s: %w", spec.Name, err)
+	}
+	if index.Options.Unique != nil {
+		spec.Unique = *index.Options.Unique
+	}
+	if index.Options.ExpireAfterSeconds != nil {
+		seconds := int64(*index.Options.ExpireAfterSeconds)
+		spec.ExpireAfterSeconds = &seconds
+	}
+	return spec, nil
+}
+
+// sameKeys compares index keys in order. Directions are compared by value
+// since the server may list them with a different numeric type.
+func sameKeys(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || fmt.Sprint(a[i].Value) != fmt.Sprint(b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameExpiry(a, b *int64) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,266 @@
+package jaeger_mongodb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Migration records the upgrade of the span documents of a collection to a
+// schema version.
+type Migration struct {
+	ID          string     `bson:"_id"` // collection and version, such as "spans:1"
+	Collection  string     `bson:"collection"`
+	Version     int        `bson:"version"`
+	Migrated    int64      `bson:"migrated"` // documents upgraded so far
+	StartedAt   time.Time  `bson:"startedAt"`
+	UpdatedAt   time.Time  `bson:"updatedAt"`
+	CompletedAt *time.Time `bson:"completedAt,omitempty"`
+}
+
+// Migrator upgrades span documents written by older versions of the plugin
+// to SchemaVersion, and records its progress in the migrations collection.
+type Migrator struct {
+	migrations *mongo.Collection
+	log        hclog.Logger
+	batchSize  int
+	reader     *SpanReader
+	writer     *SpanWriter
+}
+
+// NewMigrator returns a Migrator which records migrations in the given
+// collection and upgrades batchSize documents at a time.
+func NewMigrator(migrations *mongo.Collection, logger hclog.Logger, batchSize int) *Migrator {
+	if logger == nil {
+		logger = hclog.NewNullLogger()
+	}
+	return &Migrator{
+		migrations: migrations,
+		log:        logger,
+		batchSize:  batchSize,
+		reader:     NewSpanReader(nil, logger, 0),
+		// The archive writer leaves the _id alone, which the upgraded
+		// document keeps.
+		writer: NewArchiveSpanWriter(nil, logger, 0),
+	}
+}
+
+// GetMigration returns the Migration of the collection to SchemaVersion, or
+// nil if it was never started.
+func (m *Migrator) GetMigration(ctx context.Context, collection string) (*Migration, error) {
+	var migration Migration
+	err := m.migrations.FindOne(ctx, bson.D{{Key: "_id", Value: migrationID(collection)}}).Decode(&migration)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading migration of %s: %w", collection, err)
+	}
+	return &migration, nil
+}
+
+// Migrate upgrades the span documents of the collection, stored in the given
+// layout, to SchemaVersion and returns how many it upgraded. Every batch is
+// recorded in the Migration of the collection before the next one is read.
+// Upgraded documents no longer match the migration, so one that was
+// interrupted resumes where it stopped when run again, and spans may be
+// written while it runs. A trace document that gained a span while it was
+// upgraded is left alone and upgraded by another pass over the collection;
+// if a pass upgrades nothing while outdated documents remain, Migrate fails
+// without completing the Migration. Documents of time-series collections
+// cannot be updated, so the time-series layout is not supported.
+func (m *Migrator) Migrate(ctx context.Context, collection *mongo.Collection, layout Layout) (int64, error) {
+	if layout == LayoutTimeSeries {
+		return 0, fmt.Errorf("collection %s cannot be migrated: documents of time-series collections cannot be updated", collection.Name())
+	}
+	if err := m.start(ctx, collection.Name()); err != nil {
+		return 0, err
+	}
+
+	outdated := bson.D{{Key: "schemaVersion", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: SchemaVersion}}}}}}
+	filter := outdated
+	if layout == LayoutTrace {
+		filter = bson.D{{Key: "spans", Value: bson.D{{Key: "$elemMatch", Value: outdated}}}}
+	}
+
+	var migrated int64
+	for {
+		n, err := m.pass(ctx, collection, layout, filter)
+		migrated += n
+		if err != nil {
+			return migrated, err
+		}
+		remaining, err := collection.CountDocuments(ctx, filter)
+		if err != nil {
+			return migrated, fmt.Errorf("error counting documents to migrate in %s: %w", collection.Name(), err)
+		}
+		if remaining == 0 {
+			break
+		}
+		if n == 0 {
+			return migrated, fmt.Errorf("%d documents of %s changed while they were migrated", remaining, collection.Name())
+		}
+		m.log.Info("documents changed while they were migrated, migrating them again", "collection", collection.Name(), "count", remaining)
+	}
+	return migrated, m.complete(ctx, collection.Name())
+}
+
+// pass upgrades the documents of the collection matching the filter once and
+// returns how many it upgraded.
+func (m *Migrator) pass(ctx context.Context, collection *mongo.Collection, layout Layout, filter bson.D) (int64, error) {
+	cursor, err := collection.Find(ctx, filter, options.Find().SetBatchSize(int32(m.batchSize)))
+	if err != nil {
+		return 0, fmt.Errorf("error finding documents to migrate in %s: %w", collection.Name(), err)
+	}
+	defer cursor.Close(ctx)
+
+	var migrated int64
+	batch := make([]mongo.WriteModel, 0, m.batchSize)
+	for cursor.Next(ctx) {
+		var model mongo.WriteModel
+		if layout == LayoutTrace {
+			model, err = m.upgradeTrace(cursor)
+		} else {
+			model, err = m.upgradeSpan(cursor)
+		}
+		if err != nil {
+			return migrated, fmt.Errorf("error migrating %s: %w", collection.Name(), err)
+		}
+		batch = append(batch, model)
+		if len(batch) < m.batchSize {
+			continue
+		}
+		n, err := m.flush(ctx, collection, batch)
+		migrated += n
+		if err != nil {
+			return migrated, err
+		}
+		batch = batch[:0]
+	}
+	if err := cursor.Err(); err != nil {
+		return migrated, fmt.Errorf("error finding documents to migrate in %s: %w", collection.Name(), err)
+	}
+	n, err := m.flush(ctx, collection, batch)
+	return migrated + n, err
+}
+
+// upgradeSpan returns the replacement of the span document at the cursor.
+// The filter does not match a document that was upgraded in the meantime.
+func (m *Migrator) upgradeSpan(cursor *mongo.Cursor) (mongo.WriteModel, error) {
+	var ms Span
+	if err := cursor.Decode(&ms); err != nil {
+		return nil, fmt.Errorf("error decoding span: %w", err)
+	}
+	upgraded, err := m.upgrade(&ms)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.D{
+		{Key: "_id", Value: ms.ID},
+		{Key: "schemaVersion", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: SchemaVersion}}}}},
+	}
+	return mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(upgraded), nil
+}
+
+// upgradeTrace returns the update of the outdated spans of the TraceDocument
+// at the cursor. The filter does not match a document that a span was added
+// to in the meantime, which is then upgraded by the next pass.
+func (m *Migrator) upgradeTrace(cursor *mongo.Cursor) (mongo.WriteModel, error) {
+	var doc TraceDocument
+	if err := cursor.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("error decoding trace: %w", err)
+	}
+	for i := range doc.Spans {
+		if doc.Spans[i].SchemaVersion >= SchemaVersion {
+			continue
+		}
+		upgraded, err := m.upgrade(&doc.Spans[i])
+		if err != nil {
+			return nil, err
+		}
+		doc.Spans[i] = upgraded
+	}
+	filter := bson.D{
+		{Key: "_id", Value: doc.TraceID},
+		{Key: "spanCount", Value: doc.SpanCount},
+	}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "spans", Value: doc.Spans}}}}
+	return mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update), nil
+}
+
+// upgrade converts a span of any supported version to the domain span and
+// back, which writes it in the current version.
+func (m *Migrator) upgrade(ms *Span) (Span, error) {
+	span, err := m.reader.convertSpan(ms)
+	if err != nil {
+		return Span{}, err
+	}
+	upgraded, err := m.writer.convertSpan(span)
+	if err != nil {
+		return Span{}, fmt.Errorf("error converting span %s of trace %s: %w", ms.SpanID, ms.TraceID, err)
+	}
+	upgraded.ID = ms.ID
+	upgraded.ExpireAt = ms.ExpireAt
+	return upgraded, nil
+}
+
+// flush writes the batch and records its progress.
+func (m *Migrator) flush(ctx context.Context, collection *mongo.Collection, batch []mongo.WriteModel) (int64, error) {
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	result, err := collection.BulkWrite(ctx, batch, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, fmt.Errorf("error migrating %s: %w", collection.Name(), err)
+	}
+	update := bson.D{
+		{Key: "$inc", Value: bson.D{{Key: "migrated", Value: result.ModifiedCount}}},
+		{Key: "$set", Value: bson.D{{Key: "updatedAt", Value: time.Now()}}},
+	}
+	if _, err := m.migrations.UpdateOne(ctx, bson.D{{Key: "_id", Value: migrationID(collection.Name())}}, update); err != nil {
+		return result.ModifiedCount, fmt.Errorf("error recording migration of %s: %w", collection.Name(), err)
+	}
+	m.log.Info("migrated documents", "collection", collection.Name(), "count", result.ModifiedCount, "version", SchemaVersion)
+	return result.ModifiedCount, nil
+}
+
+// start records the Migration of the collection unless it already exists.
+func (m *Migrator) start(ctx context.Context, collection string) error {
+	now := time.Now()
+	update := bson.D{
+		{Key: "$setOnInsert", Value: bson.D{
+			{Key: "collection", Value: collection},
+			{Key: "version", Value: SchemaVersion},
+			{Key: "migrated", Value: int64(0)},
+			{Key: "startedAt", Value: now},
+		}},
+		{Key: "$set", Value: bson.D{{Key: "updatedAt", Value: now}}},
+	}
+	opts := options.Update().SetUpsert(true)
+	if _, err := m.migrations.UpdateOne(ctx, bson.D{{Key: "_id", Value: migrationID(collection)}}, update, opts); err != nil {
+		return fmt.Errorf("error recording migration of %s: %w", collection, err)
+	}
+	return nil
+}
+
+// complete records that the Migration of the collection was applied.
+func (m *Migrator) complete(ctx context.Context, collection string) error {
+	now := time.Now()
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "updatedAt", Value: now},
+		{Key: "completedAt", Value: now},
+	}}}
+	if _, err := m.migrations.UpdateOne(ctx, bson.D{{Key: "_id", Value: migrationID(collection)}}, update); err != nil {
+		return fmt.Errorf("error recording migration of %s: %w", collection, err)
+	}
+	return nil
+}
+
+func migrationID(collection string) string {
+	return fmt.Sprintf("%s:%d", collection, SchemaVersion)
+}
@@ -0,0 +1,62 @@
+package jaeger_mongodb
+
+import (
+	"io"
+
+	"github.com/jaegertracing/jaeger/storage/dependencystore"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// StorePlugin serves the span, archive and streaming stores of the gRPC
+// storage plugin.
+type StorePlugin struct {
+	reader        *SpanReader
+	writer        spanstore.Writer
+	archiveReader *SpanReader
+	archiveWriter *SpanWriter
+}
+
+// NewStorePlugin returns a StorePlugin. The writer may be a
+// BufferedSpanWriter, which Close flushes.
+func NewStorePlugin(reader *SpanReader, writer spanstore.Writer, archiveReader *SpanReader, archiveWriter *SpanWriter) *StorePlugin {
+	return &StorePlugin{
+		reader:        reader,
+		writer:        writer,
+		archiveReader: archiveReader,
+		archiveWriter: archiveWriter,
+	}
+}
+
+func (s *StorePlugin) DependencyReader() dependencystore.Reader {
+	return s.reader
+}
+
+func (s *StorePlugin) SpanReader() spanstore.Reader {
+	return s.reader
+}
+
+func (s *StorePlugin) SpanWriter() spanstore.Writer {
+	return s.writer
+}
+
+func (s *StorePlugin) ArchiveSpanReader() spanstore.Reader {
+	return s.archiveReader
+}
+
+func (s *StorePlugin) ArchiveSpanWriter() spanstore.Writer {
+	return s.archiveWriter
+}
+
+// StreamingSpanWriter lets the collector stream spans to the plugin over a
+// single gRPC stream instead of issuing one unary call per span.
+func (s *StorePlugin) StreamingSpanWriter() spanstore.Writer {
+	return s.writer
+}
+
+// Close flushes and stops the span writer if it buffers writes.
+func (s *StorePlugin) Close() error {
+	if closer, ok := s.writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"sort"
 	"strconv"
 	"time"
 
@@ -12,30 +12,93 @@ import (
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
-	"go.uber.org/zap"
 )
 
 var (
-	ErrTraceNotFound         = errors.New("trace not found")
-	Empty                    struct{}
-	maxTracesForDependencies = 25000
-	tracer                   = otel.Tracer("reader")
+	ErrTraceNotFound = errors.New("trace not found")
+	tracer           = otel.Tracer("reader")
 )
 
+// TimeoutError is returned when a read exceeds mongoTimeoutDuration on the
+// server or is not answered before the deadline of its context.
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("query timed out: %s", e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// maxTimeMSExpiredCode is the server error code of a command that exceeded
+// its maxTimeMS.
+const maxTimeMSExpiredCode = 50
+
+// readError wraps the error of a read with msg, as a *TimeoutError if the read
+// ran out of time.
+func readError(msg string, err error) error {
+	err = fmt.Errorf("%s: %w", msg, err)
+	var cmdErr mongo.CommandError
+	if mongo.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &cmdErr) && cmdErr.Code == maxTimeMSExpiredCode) {
+		return &TimeoutError{Err: err}
+	}
+	return err
+}
+
+// TagMatchMode selects on which spans of a trace the tags of a FindTraces
+// query must be found.
+type TagMatchMode string
+
+const (
+	// TagMatchSpan requires every tag on the span matching the other filters
+	// of the query.
+	TagMatchSpan TagMatchMode = "span"
+	// TagMatchTrace accepts each tag on any span of the trace, e.g. error=true
+	// on one span and customer.id=X on another.
+	TagMatchTrace TagMatchMode = "trace"
+)
+
+// TagMatchTag is a reserved query tag which selects the TagMatchMode of a
+// single query, e.g. mongo.tag_match=trace. It is not matched against spans.
+const TagMatchTag = "mongo.tag_match"
+
+// ParseTagMatchMode returns the TagMatchMode named s.
+func ParseTagMatchMode(s string) (TagMatchMode, error) {
+	switch mode := TagMatchMode(s); mode {
+	case TagMatchSpan, TagMatchTrace:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid tag match mode %q, expected %q or %q", s, TagMatchSpan, TagMatchTrace)
+	}
+}
+
+//go:generate mockgen -source=reader.go -destination=../../mocks/reader_mock.go -package=mocks
+
 type ReaderStorage interface {
+	Aggregate(ctx context.Context, pipeline interface{}, opts *options.AggregateOptions) (*mongo.Cursor, error)
 	Distinct(ctx context.Context, field string, filter interface{}, opts *options.DistinctOptions) ([]interface{}, error)
 	Find(ctx context.Context, filter interface{}, opts *options.FindOptions) (*mongo.Cursor, error)
+	Name() string
 }
 
 type MongoReaderStorage struct {
 	c *mongo.Collection
 }
 
+func (m MongoReaderStorage) Aggregate(ctx context.Context, pipeline interface{}, opts *options.AggregateOptions) (*mongo.Cursor, error) {
+	return m.c.Aggregate(ctx, pipeline, opts)
+}
+
 func (m MongoReaderStorage) Distinct(ctx context.Context, field string, filter interface{}, opts *options.DistinctOptions) ([]interface{}, error) {
 	return m.c.Distinct(ctx, field, filter, opts)
 }
@@ -44,6 +107,10 @@ func (m MongoReaderStorage) Find(ctx context.Context, filter interface{}, opts *
 	return m.c.Find(ctx, filter, opts)
 }
 
+func (m MongoReaderStorage) Name() string {
+	return m.c.Name()
+}
+
 func NewMongoReaderStorage(c *mongo.Collection) *MongoReaderStorage {
 	return &MongoReaderStorage{c: c}
 }
@@ -53,16 +120,57 @@ type SpanReader struct {
 	storage              ReaderStorage
 	log                  hclog.Logger
 	mongoTimeoutDuration time.Duration
+	// dependencies stores the links computed by DependenciesRollup. When
+	// nil, the links are computed from the spans on every call.
+	dependencies ReaderStorage
+	// catalog stores the operations recorded by the SpanWriter. When nil,
+	// services and operations are read from the spans.
+	catalog ReaderStorage
+	// tagMatch is the TagMatchMode of queries without a TagMatchTag.
+	tagMatch TagMatchMode
+	layout   Layout
 }
 
 func NewSpanReader(readerStorage ReaderStorage, logger hclog.Logger, mongoTimeoutDuration time.Duration) *SpanReader {
+	if logger == nil {
+		logger = hclog.NewNullLogger()
+	}
 	return &SpanReader{
 		log:                  logger,
 		storage:              readerStorage,
 		mongoTimeoutDuration: mongoTimeoutDuration,
+		tagMatch:             TagMatchSpan,
+		layout:               LayoutSpan,
 	}
 }
 
+// WithLayout sets the Layout of the spans in the storage.
+func (s *SpanReader) WithLayout(layout Layout) *SpanReader {
+	s.layout = layout
+	return s
+}
+
+// WithDependenciesStorage makes GetDependencies read the dependency links
+// rolled up by DependenciesRollup into the given storage.
+func (s *SpanReader) WithDependenciesStorage(dependencies ReaderStorage) *SpanReader {
+	s.dependencies = dependencies
+	return s
+}
+
+// WithTagMatch sets the TagMatchMode of the queries that do not select one
+// with a TagMatchTag.
+func (s *SpanReader) WithTagMatch(mode TagMatchMode) *SpanReader {
+	s.tagMatch = mode
+	return s
+}
+
+// WithCatalogStorage makes GetServices and GetOperations read the catalog
+// maintained by the SpanWriter in the given storage.
+func (s *SpanReader) WithCatalogStorage(catalog ReaderStorage) *SpanReader {
+	s.catalog = catalog
+	return s
+}
+
 // GetTrace retrieve the given traceID.
 func (s *SpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
 	ctx, span := tracer.Start(ctx, "GetTrace")
@@ -71,6 +179,7 @@ func (s *SpanReader) GetTrace(ctx context.Context, traceID model.TraceID) (*mode
 	span.SetAttributes(attribute.Key("traceID").String(traceID.String()))
 	tracesMap, err := s.fetchTracesById(ctx, []string{traceID.String()})
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
 	for i := range tracesMap {
@@ -87,41 +196,138 @@ func (s *SpanReader) GetServices(ctx context.Context) ([]string, error) {
 
 	opts := options.Distinct().SetMaxTime(s.mongoTimeoutDuration)
 
-	services, err := s.storage.Distinct(ctx, "process.serviceName", bson.D{}, opts)
+	storage, field := s.storage, "process.serviceName"
+	if s.layout == LayoutTrace {
+		field = "spans.process.serviceName"
+	}
+	if s.catalog != nil {
+		storage, field = s.catalog, "serviceName"
+	}
+	services, err := storage.Distinct(ctx, field, bson.D{}, opts)
 	if err != nil {
+		err = readError("distinct call failed", err)
 		span.SetStatus(codes.Error, err.Error())
-		return nil, fmt.Errorf("distinct call failed: %s", err)
+		return nil, err
 	}
 
-	return toStringArray(services)
+	array, err := toStringArray(services)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	return array, nil
 }
 
-// GetOperations returns all operation names for a given service
-// known to the backend from spans within its retention period.
+// GetOperations returns all operation names and span kinds for a given
+// service known to the backend from spans within its retention period,
+// restricted to the query's span kind if one is given.
 func (s *SpanReader) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
-	_, span := tracer.Start(ctx, "GetOperations")
+	ctx, span := tracer.Start(ctx, "GetOperations")
 	defer span.End()
 
-	opts := options.Distinct().SetMaxTime(s.mongoTimeoutDuration)
-	filter := bson.D{}
 	if query.ServiceName != "" {
-		filter = bson.D{{Key: "process.serviceName", Value: query.ServiceName}}
 		span.SetAttributes(attribute.Key("process.serviceName").String(query.ServiceName))
 	}
-	ops, err := s.storage.Distinct(ctx, "operationName", filter, opts)
+	if query.SpanKind != "" {
+		span.SetAttributes(attribute.Key("spanKind").String(query.SpanKind))
+	}
 
+	var ops []spanstore.Operation
+	var err error
+	if s.catalog != nil {
+		ops, err = s.getCatalogOperations(ctx, query)
+	} else {
+		ops, err = s.getSpanOperations(ctx, query)
+	}
 	if err != nil {
 		span.SetStatus(codes.Error, err.Error())
-		return nil, fmt.Errorf("distinct call failed: %s", err)
+		return nil, err
+	}
+	return ops, nil
+}
+
+func (s *SpanReader) getSpanOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	filter := bson.D{}
+	if query.ServiceName != "" {
+		filter = append(filter, bson.E{Key: "process.serviceName", Value: query.ServiceName})
+	}
+	if query.SpanKind != "" {
+		filter = append(filter, bson.E{Key: "spanKind", Value: query.SpanKind})
+	}
+	var pipeline mongo.Pipeline
+	if s.layout == LayoutTrace && query.ServiceName != "" {
+		// Select the trace documents of the service through the
+		// ServiceNameAndOperationsIndex before unwinding their spans.
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.D{{Key: "spans.process.serviceName", Value: query.ServiceName}}}})
+	}
+	pipeline = append(pipeline, spanStages(s.layout, filter)...)
+	pipeline = append(pipeline,
+		bson.D{{Key: "$group", Value: bson.D{{Key: "_id", Value: bson.D{
+			{Key: "operationName", Value: "$operationName"},
+			{Key: "spanKind", Value: "$spanKind"},
+		}}}}},
+		bson.D{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: "$_id"}}}},
+	)
+	opts := options.Aggregate().SetMaxTime(s.mongoTimeoutDuration)
+	cursor, err := s.storage.Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		return nil, readError("error aggregating operations", err)
+	}
+	return decodeOperations(ctx, cursor)
+}
+
+func (s *SpanReader) getCatalogOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	filter := bson.D{}
+	if query.ServiceName != "" {
+		filter = append(filter, bson.E{Key: "serviceName", Value: query.ServiceName})
 	}
+	if query.SpanKind != "" {
+		filter = append(filter, bson.E{Key: "spanKind", Value: query.SpanKind})
+	}
+	opts := options.Find().
+		SetProjection(bson.D{{Key: "operationName", Value: 1}, {Key: "spanKind", Value: 1}}).
+		SetMaxTime(s.mongoTimeoutDuration)
+	cursor, err := s.catalog.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, readError("error finding operations", err)
+	}
+	return decodeOperations(ctx, cursor)
+}
+
+// decodeOperations returns one spanstore.Operation per distinct operation
+// name and span kind found by the cursor, closing it.
+func decodeOperations(ctx context.Context, cursor *mongo.Cursor) ([]spanstore.Operation, error) {
+	defer cursor.Close(ctx)
 
-	return toStringOperations(ops)
+	// The catalog records the same operation once per service.
+	seen := make(map[spanstore.Operation]struct{})
+	ops := []spanstore.Operation{}
+	for cursor.Next(ctx) {
+		var entry Operation
+		if err := cursor.Decode(&entry); err != nil {
+			return nil, fmt.Errorf("error decoding operation: %w", err)
+		}
+		op := spanstore.Operation{
+			Name:     entry.OperationName,
+			SpanKind: entry.SpanKind,
+		}
+		if _, ok := seen[op]; !ok {
+			seen[op] = struct{}{}
+			ops = append(ops, op)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, readError("error finding operations", err)
+	}
+	return ops, nil
 }
 
 // FindTraces returns all traces matching query parameters. There's currently
 // an implementation-dependent abiguity whether all query filters (such as
 // multiple tags) must apply to the same span within a trace, or can be satisfied
-// by different spans.
+// by different spans. Here it depends on the TagMatchMode: the service,
+// operation and duration filters always apply to one span, and the tags
+// either to that span or to any span of the trace.
 //
 // If no matching traces are found, the function returns (nil, nil).
 func (s *SpanReader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
@@ -144,9 +350,12 @@ func (s *SpanReader) FindTraces(ctx context.Context, query *spanstore.TraceQuery
 		return nil, err
 	}
 
-	var traces []*model.Trace
-	for _, trace := range tracesMap {
-		traces = append(traces, trace)
+	// Keep the order of the IDs, most recent trace first.
+	traces := make([]*model.Trace, 0, len(ids))
+	for _, id := range ids {
+		if trace, ok := tracesMap[id]; ok {
+			traces = append(traces, trace)
+		}
 	}
 
 	return traces, nil
@@ -157,11 +366,12 @@ func (s *SpanReader) FindTraces(ctx context.Context, query *spanstore.TraceQuery
 //
 // If no matching traces are found, the function returns (nil, nil).
 func (s *SpanReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
-	_, span := tracer.Start(ctx, "FindTraceIDs")
+	ctx, span := tracer.Start(ctx, "FindTraceIDs")
 	defer span.End()
 
 	ids, err := s.findTraceIDs(ctx, query)
 	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
 		return nil, err
 	}
 
@@ -173,6 +383,8 @@ func (s *SpanReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQue
 	for i, id := range ids {
 		t, err := model.TraceIDFromString(id)
 		if err != nil {
+			err = fmt.Errorf("invalid traceID %q: %w", id, err)
+			span.SetStatus(codes.Error, err.Error())
 			return nil, err
 		}
 		traceIDs[i] = t
@@ -181,249 +393,564 @@ func (s *SpanReader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQue
 	return traceIDs, nil
 }
 
+// GetDependencies returns the parent/child service links of all spans started
+// within lookback before endTs. The links are computed by MongoDB.
 func (s *SpanReader) GetDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
-	_, span := tracer.Start(ctx, "GetDependencies")
+	ctx, span := tracer.Start(ctx, "GetDependencies")
 	defer span.End()
 
-	traces, err := s.FindTraces(ctx,
-		&spanstore.TraceQueryParameters{
-			StartTimeMin: endTs.Add(-1 * lookback),
-			StartTimeMax: endTs,
-			NumTraces:    maxTracesForDependencies,
-		},
-	)
+	if s.dependencies != nil {
+		dls, err := s.getRolledUpDependencies(ctx, endTs, lookback)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+		return dls, nil
+	}
+
+	pipeline := linksPipeline(s.layout, s.storage.Name(), endTs.Add(-1*lookback), endTs)
+	opts := options.Aggregate().SetAllowDiskUse(true).SetMaxTime(s.mongoTimeoutDuration)
+	cursor, err := s.storage.Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, readError("error aggregating dependency links", err)
+	}
+	defer cursor.Close(ctx)
+
+	dls := []model.DependencyLink{}
+	for cursor.Next(ctx) {
+		var link dependencyLink
+		if err := cursor.Decode(&link); err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			return nil, fmt.Errorf("error decoding dependency link: %w", err)
+		}
+		dls = append(dls, model.DependencyLink{
+			Parent:    link.ID.Parent,
+			Child:     link.ID.Child,
+			CallCount: uint64(link.CallCount),
+		})
+	}
+	if err := cursor.Err(); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, readError("error aggregating dependency links", err)
+	}
+	return dls, nil
+}
+
+// getRolledUpDependencies merges the links of every rolled up interval
+// overlapping the lookback window. Intervals are counted in full, so the call
+// counts include the calls of the intervals at either end of the window that
+// were made outside of it. Counting only the intervals within the window
+// would instead return no links for windows shorter than an interval.
+func (s *SpanReader) getRolledUpDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	filter := bson.M{
+		"_id":     bson.M{"$lt": endTs},
+		"endTime": bson.M{"$gt": endTs.Add(-1 * lookback)},
+	}
+	opts := options.Find().SetMaxTime(s.mongoTimeoutDuration)
+	cursor, err := s.dependencies.Find(ctx, filter, opts)
 	if err != nil {
-		zap.S().Error(err)
+		return nil, readError("error finding dependency links", err)
 	}
-	// Map spanID to serviceName.
-	serviceNameBySpanID := make(map[model.SpanID]string)
+	defer cursor.Close(ctx)
+
 	m := make(map[string]*model.DependencyLink)
-	for _, trace := range traces {
-		for _, s := range trace.Spans {
-			serviceNameBySpanID[s.SpanID] = s.Process.ServiceName
-		}
-	}
-	for _, trace := range traces {
-		for _, s := range trace.Spans {
-			for _, ref := range s.References {
-				if ref.GetRefType() == model.SpanRefType_CHILD_OF && serviceNameBySpanID[ref.SpanID] != "" {
-					parent, child := serviceNameBySpanID[ref.SpanID], s.Process.ServiceName
-					dl := m[parent+child]
-					if dl == nil {
-						dl = &model.DependencyLink{
-							Parent:    parent,
-							Child:     child,
-							CallCount: 0,
-						}
-						m[parent+child] = dl
-					}
-					dl.CallCount++
+	for cursor.Next(ctx) {
+		var deps Dependencies
+		if err := cursor.Decode(&deps); err != nil {
+			return nil, fmt.Errorf("error decoding dependency links: %w", err)
+		}
+		for _, d := range deps.Links {
+			key := d.Parent + "\x00" + d.Child
+			dl := m[key]
+			if dl == nil {
+				dl = &model.DependencyLink{
+					Parent: d.Parent,
+					Child:  d.Child,
 				}
+				m[key] = dl
 			}
+			dl.CallCount += uint64(d.CallCount)
 		}
 	}
+	if err := cursor.Err(); err != nil {
+		return nil, readError("error finding dependency links", err)
+	}
 
 	dls := []model.DependencyLink{}
 	for _, dl := range m {
-		if dl.Parent != dl.Child {
-			dls = append(dls, *dl)
-		}
+		dls = append(dls, *dl)
 	}
 	return dls, nil
 }
 
+// dependencyLink is a result document of dependencyLinksPipeline.
+type dependencyLink struct {
+	ID struct {
+		Parent string `bson:"parent"`
+		Child  string `bson:"child"`
+	} `bson:"_id"`
+	CallCount int64 `bson:"callCount"`
+}
+
+// dependencyLinksPipeline counts the CHILD_OF references between spans of
+// different services started in [start, end), grouped by parent and child
+// service. Parent spans are looked up by traceID and spanID in collection.
+func dependencyLinksPipeline(collection string, start, end time.Time) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"startTime":          bson.M{"$gte": start, "$lt": end},
+			"references.refType": ChildOf,
+		}}},
+		{{Key: "$unwind", Value: "$references"}},
+		{{Key: "$match", Value: bson.M{"references.refType": ChildOf}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": collection,
+			"let": bson.M{
+				"traceID": "$references.traceID",
+				"spanID":  "$references.spanID",
+			},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+					bson.M{"$eq": bson.A{"$traceID", "$$traceID"}},
+					bson.M{"$eq": bson.A{"$spanID", "$$spanID"}},
+				}}}},
+				bson.M{"$limit": 1},
+				bson.M{"$project": bson.M{"_id": 0, "serviceName": "$process.serviceName"}},
+			},
+			"as": "parent",
+		}}},
+		{{Key: "$unwind", Value: "$parent"}},
+		{{Key: "$match", Value: bson.M{"$expr": bson.M{"$ne": bson.A{"$parent.serviceName", "$process.serviceName"}}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"parent": "$parent.serviceName",
+				"child":  "$process.serviceName",
+			},
+			"callCount": bson.M{"$sum": 1},
+		}}},
+	}
+}
+
 // Internal method used to find traces
 func (s *SpanReader) fetchTracesById(ctx context.Context, ids []string) (map[string]*model.Trace, error) {
-	_, span := tracer.Start(ctx, "fetchTracesById")
+	ctx, span := tracer.Start(ctx, "fetchTracesById")
 	defer span.End()
 
+	if s.layout == LayoutTrace {
+		tracesMap, err := s.fetchTraceDocuments(ctx, ids)
+		if err != nil {
+			s.log.Error("error finding traces", "err", err)
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
+		}
+		return tracesMap, nil
+	}
+
 	filter := bson.M{
 		"traceID": bson.M{"$in": ids},
 	}
 
-	findOpts := options.FindOptions{}
-	cur, err := s.storage.Find(ctx, filter, &findOpts)
+	findOpts := options.Find().SetMaxTime(s.mongoTimeoutDuration)
+	cur, err := s.storage.Find(ctx, filter, findOpts)
 
 	if err != nil {
 		s.log.Error("error finding spans", "err", err)
-		return nil, fmt.Errorf("error finding spans %w", err)
+		err = readError("error finding spans", err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
 	}
 
 	defer cur.Close(ctx)
 
 	tracesMap := make(map[string]*model.Trace, len(ids))
+	// Time-series collections do not enforce unique _ids, so a retried
+	// write may have stored a span twice.
+	seen := make(map[interface{}]struct{})
 	for cur.Next(ctx) {
 		var ms Span
-		err := cur.Decode(&ms)
-
-		if err != nil {
+		if err := cur.Decode(&ms); err != nil {
 			s.log.Error("error decoding span", "err", err)
-			return nil, fmt.Errorf("error decoding span: %w", err)
-		}
-
-		if _, ok := tracesMap[ms.TraceID]; !ok {
-			tracesMap[ms.TraceID] = &model.Trace{}
-		}
-
-		tId, err := model.TraceIDFromString(ms.TraceID)
-		if err != nil {
+			err = fmt.Errorf("error decoding span: %w", err)
+			span.SetStatus(codes.Error, err.Error())
 			return nil, err
 		}
-
-		sId, err := model.SpanIDFromString(ms.SpanID)
-		if err != nil {
-			return nil, err
+		if s.layout == LayoutTimeSeries && ms.ID != nil {
+			if _, ok := seen[ms.ID]; ok {
+				continue
+			}
+			seen[ms.ID] = struct{}{}
 		}
 
-		refs, err := s.convertRefs(ms.References)
-		if err != nil {
-			return nil, err
-		}
-		tags, err := s.convertKeyValues(ms.Tags)
-		if err != nil {
-			return nil, err
-		}
-		pTags, err := s.convertKeyValues(ms.Process.Tags)
+		mSpan, err := s.convertSpan(&ms)
 		if err != nil {
+			s.log.Error("error converting span", "err", err)
+			span.SetStatus(codes.Error, err.Error())
 			return nil, err
 		}
 
-		s := model.Span{
-			TraceID:       tId,
-			SpanID:        sId,
-			OperationName: ms.OperationName,
-			References:    refs,
-			StartTime:     ms.StartTime,
-			Duration:      model.MicrosecondsAsDuration(uint64(ms.Duration)),
-			Tags:          tags,
-			Logs:          []model.Log{}, // TODO(dmichel): implement
-			Process: &model.Process{
-				ServiceName: ms.Process.ServiceName,
-				Tags:        pTags,
-			},
-			Warnings: []string{}, // TODO(dmichel): implement
+		if _, ok := tracesMap[ms.TraceID]; !ok {
+			tracesMap[ms.TraceID] = &model.Trace{}
 		}
-
-		tracesMap[ms.TraceID].Spans = append(tracesMap[ms.TraceID].Spans, &s)
+		tracesMap[ms.TraceID].Spans = append(tracesMap[ms.TraceID].Spans, mSpan)
 	}
 
 	if err := cur.Err(); err != nil {
 		s.log.Error("error decoding span", "err", err)
-		return nil, fmt.Errorf("error with finding span %w", err)
+		err = readError("error with finding span", err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
 	}
 
 	return tracesMap, nil
 }
 
-// Internal method used to find traceIDs.
-func (s *SpanReader) findTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]string, error) {
-	_, span := tracer.Start(ctx, "findTraceIds")
-	defer span.End()
+// fetchTraceDocuments is fetchTracesById for the trace layout.
+func (s *SpanReader) fetchTraceDocuments(ctx context.Context, ids []string) (map[string]*model.Trace, error) {
+	filter := bson.M{
+		"_id": bson.M{"$in": ids},
+	}
+	findOpts := options.Find().SetMaxTime(s.mongoTimeoutDuration)
+	cur, err := s.storage.Find(ctx, filter, findOpts)
+	if err != nil {
+		return nil, readError("error finding traces", err)
+	}
+	defer cur.Close(ctx)
 
-	filter := bson.M{}
+	tracesMap := make(map[string]*model.Trace, len(ids))
+	for cur.Next(ctx) {
+		var doc TraceDocument
+		if err := cur.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("error decoding trace: %w", err)
+		}
+		trace := &model.Trace{Spans: make([]*model.Span, 0, len(doc.Spans))}
+		for i := range doc.Spans {
+			mSpan, err := s.convertSpan(&doc.Spans[i])
+			if err != nil {
+				return nil, err
+			}
+			trace.Spans = append(trace.Spans, mSpan)
+		}
+		tracesMap[doc.TraceID] = trace
+	}
+	if err := cur.Err(); err != nil {
+		return nil, readError("error finding traces", err)
+	}
+	return tracesMap, nil
+}
 
-	filter["startTime"] = bson.M{
-		"$gt": query.StartTimeMin,
-		"$lt": query.StartTimeMax,
+// convertSpan converts a stored span to the domain span.
+func (s *SpanReader) convertSpan(ms *Span) (*model.Span, error) {
+	if ms.SchemaVersion > SchemaVersion {
+		return nil, fmt.Errorf("span %s of trace %s has schema version %d, expected at most %d", ms.SpanID, ms.TraceID, ms.SchemaVersion, SchemaVersion)
 	}
 
-	// Filtering by concatenation of tags.
-	tags_array := bson.A{}
-	for k, v := range query.Tags {
-		tags_array = append(tags_array, bson.M{"tags": bson.M{"$elemMatch": bson.M{"key": k, "value": v}}})
+	tId, err := model.TraceIDFromString(ms.TraceID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid traceID %q: %w", ms.TraceID, err)
 	}
-	if len(tags_array) != 0 {
-		filter["$and"] = tags_array
+
+	sId, err := model.SpanIDFromString(ms.SpanID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spanID %q of trace %s: %w", ms.SpanID, ms.TraceID, err)
 	}
 
-	if query.ServiceName != "" {
-		filter["process.serviceName"] = query.ServiceName
+	refs, err := s.convertRefs(ms.References)
+	if err != nil {
+		return nil, fmt.Errorf("invalid references of span %s: %w", ms.SpanID, err)
+	}
+	tags, err := s.convertKeyValues(ms.Tags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tags of span %s: %w", ms.SpanID, err)
+	}
+	pTags, err := s.convertKeyValues(ms.Process.Tags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid process tags of span %s: %w", ms.SpanID, err)
+	}
+	logs, err := s.convertLogs(ms.Logs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid logs of span %s: %w", ms.SpanID, err)
 	}
 
-	if query.OperationName != "" {
-		filter["operationName"] = query.OperationName
+	return &model.Span{
+		TraceID:       tId,
+		SpanID:        sId,
+		OperationName: ms.OperationName,
+		References:    refs,
+		StartTime:     ms.StartTime,
+		Duration:      model.MicrosecondsAsDuration(uint64(ms.Duration)),
+		Flags:         model.Flags(ms.Flags),
+		Tags:          tags,
+		Logs:          logs,
+		ProcessID:     ms.ProcessID,
+		Process: &model.Process{
+			ServiceName: ms.Process.ServiceName,
+			Tags:        pTags,
+		},
+		Warnings: ms.Warnings,
+	}, nil
+}
+
+// tagMatchMode returns the mode of the query, which is the configured mode
+// unless the query has a TagMatchTag, and the query without that tag.
+func (s *SpanReader) tagMatchMode(query *spanstore.TraceQueryParameters) (*spanstore.TraceQueryParameters, TagMatchMode, error) {
+	v, ok := query.Tags[TagMatchTag]
+	if !ok {
+		return query, s.tagMatch, nil
+	}
+	mode, err := ParseTagMatchMode(v)
+	if err != nil {
+		return nil, "", err
 	}
 
-	if query.DurationMax != 0 {
-		filter["duration"] = bson.M{
-			"$lte": query.DurationMax.Microseconds(),
+	q := *query
+	q.Tags = make(map[string]string, len(query.Tags)-1)
+	for k, v := range query.Tags {
+		if k != TagMatchTag {
+			q.Tags[k] = v
 		}
 	}
+	return &q, mode, nil
+}
 
-	if query.DurationMin != 0 {
-		filter["duration"] = bson.M{
-			"$gte": query.DurationMin.Microseconds(),
-		}
+// Internal method used to find traceIDs.
+func (s *SpanReader) findTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "findTraceIds")
+	defer span.End()
+
+	query, mode, err := s.tagMatchMode(query)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
 	}
 
-	if query.DurationMax != 0 && query.DurationMin != 0 {
-		filter["duration"] = bson.M{
-			"$lte": query.DurationMax.Microseconds(),
-			"$gte": query.DurationMin.Microseconds(),
+	var pipeline mongo.Pipeline
+	if s.layout == LayoutTrace {
+		pipeline = traceDocumentsPipeline(query, mode)
+	} else if mode == TagMatchTrace && len(query.Tags) != 0 {
+		pipeline = traceTagsPipeline(query)
+	} else {
+		pipeline = mongo.Pipeline{
+			{{Key: "$match", Value: spanFilter(query)}},
+			{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: "$traceID"},
+				{Key: "startTime", Value: bson.D{{Key: "$max", Value: "$startTime"}}},
+			}}},
 		}
 	}
 
-	opts := options.FindOptions{
-		Projection: bson.D{{"traceID", 1}},
-		Sort:       bson.D{{"startTime", -1}},
+	// Order the traces by their most recent matching span and only return
+	// the newest NumTraces of them.
+	pipeline = append(pipeline, bson.D{{Key: "$sort", Value: bson.D{{Key: "startTime", Value: -1}, {Key: "_id", Value: 1}}}})
+	if query.NumTraces > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: query.NumTraces}})
 	}
 
-	cursor, err := s.storage.Find(ctx, filter, &opts)
-	defer cursor.Close(ctx)
-
+	opts := options.Aggregate().SetAllowDiskUse(true).SetMaxTime(s.mongoTimeoutDuration)
+	cursor, err := s.storage.Aggregate(ctx, pipeline, opts)
 	if err != nil {
 		s.log.Error("error getting traceIDs", "err", err)
-		return nil, fmt.Errorf("error getting traceIDs: %w", err)
+		err = readError("error getting traceIDs", err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
 	}
+	defer cursor.Close(ctx)
 
-	traceIds := make(map[string]interface{})
+	var ids []string
 	for cursor.Next(ctx) {
-		var span Span
-		if err = cursor.Decode(&span); err != nil {
-			log.Fatal(err)
+		var result struct {
+			TraceID string `bson:"_id"`
 		}
-		traceIds[span.TraceID] = Empty
-
-		// Only fetch as many tracesIds up to the limit.
-		if len(traceIds) >= query.NumTraces {
-			break
+		if err := cursor.Decode(&result); err != nil {
+			err = fmt.Errorf("error decoding traceID: %w", err)
+			span.SetStatus(codes.Error, err.Error())
+			return nil, err
 		}
+		ids = append(ids, result.TraceID)
 	}
-
-	ids := make([]string, 0, query.NumTraces)
-	for k, _ := range traceIds {
-		ids = append(ids, k)
+	if err := cursor.Err(); err != nil {
+		err = readError("error getting traceIDs", err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
 	}
 
 	return ids, nil
 }
 
-func toStringArray(arr []interface{}) ([]string, error) {
-	array := make([]string, len(arr))
+// spanFilter returns the predicate a single span must satisfy for its trace
+// to match the query: every given filter, including the duration range and
+// all tags, applies to the same span.
+func spanFilter(query *spanstore.TraceQueryParameters) bson.D {
+	filter := spanFields(query)
 
-	for i, s := range arr {
-		str, ok := s.(string)
-		if !ok {
-			return nil, errors.New("non-string key found")
-		}
-		array[i] = str
+	filter = append(filter, bson.E{Key: "startTime", Value: startTimeRange(query)})
+
+	tags := bson.A{}
+	for _, k := range sortedTagKeys(query.Tags) {
+		tags = append(tags, tagFilter(k, query.Tags[k]))
+	}
+	if len(tags) != 0 {
+		filter = append(filter, bson.E{Key: "$and", Value: tags})
 	}
 
-	return array, nil
+	return filter
+}
+
+// traceTagsPipeline returns the stages selecting the traces in which one span
+// matches the service, operation and duration filters of the query and each
+// tag is found on any span, not necessarily the same one. The output has one
+// document per trace, like the $group stage of findTraceIDs.
+func traceTagsPipeline(query *spanstore.TraceQueryParameters) mongo.Pipeline {
+	keys := sortedTagKeys(query.Tags)
+
+	// Only the spans that can contribute to the match are grouped.
+	candidates := bson.A{}
+	if fields := spanFields(query); len(fields) != 0 {
+		candidates = append(candidates, fields)
+	}
+	for _, k := range keys {
+		candidates = append(candidates, tagFilter(k, query.Tags[k]))
+	}
+	filter := bson.D{
+		{Key: "startTime", Value: startTimeRange(query)},
+		{Key: "$or", Value: candidates},
+	}
+
+	group := bson.D{
+		{Key: "_id", Value: "$traceID"},
+		{Key: "startTime", Value: bson.D{{Key: "$max", Value: "$startTime"}}},
+		{Key: "span", Value: bson.D{{Key: "$max", Value: spanFieldsExpr(query)}}},
+	}
+	matched := bson.D{{Key: "span", Value: true}}
+	for i, k := range keys {
+		field := fmt.Sprintf("tag%d", i)
+		group = append(group, bson.E{Key: field, Value: bson.D{{Key: "$max", Value: tagExpr(k, query.Tags[k])}}})
+		matched = append(matched, bson.E{Key: field, Value: true})
+	}
+
+	return mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: group}},
+		{{Key: "$match", Value: matched}},
+	}
+}
+
+// spanFields returns the service, operation and duration filters of the
+// query.
+func spanFields(query *spanstore.TraceQueryParameters) bson.D {
+	filter := bson.D{}
+
+	if query.ServiceName != "" {
+		filter = append(filter, bson.E{Key: "process.serviceName", Value: query.ServiceName})
+	}
+
+	if query.OperationName != "" {
+		filter = append(filter, bson.E{Key: "operationName", Value: query.OperationName})
+	}
+
+	duration := bson.D{}
+	if query.DurationMin != 0 {
+		duration = append(duration, bson.E{Key: "$gte", Value: query.DurationMin.Microseconds()})
+	}
+	if query.DurationMax != 0 {
+		duration = append(duration, bson.E{Key: "$lte", Value: query.DurationMax.Microseconds()})
+	}
+	if len(duration) != 0 {
+		filter = append(filter, bson.E{Key: "duration", Value: duration})
+	}
+
+	return filter
+}
+
+// spanFieldsExpr is the aggregation expression equivalent of spanFields. It
+// is true for every span if the query has none of those filters.
+func spanFieldsExpr(query *spanstore.TraceQueryParameters) bson.D {
+	conditions := bson.A{}
+	if query.ServiceName != "" {
+		conditions = append(conditions, bson.D{{Key: "$eq", Value: bson.A{"$process.serviceName", query.ServiceName}}})
+	}
+	if query.OperationName != "" {
+		conditions = append(conditions, bson.D{{Key: "$eq", Value: bson.A{"$operationName", query.OperationName}}})
+	}
+	if query.DurationMin != 0 {
+		conditions = append(conditions, bson.D{{Key: "$gte", Value: bson.A{"$duration", query.DurationMin.Microseconds()}}})
+	}
+	if query.DurationMax != 0 {
+		conditions = append(conditions, bson.D{{Key: "$lte", Value: bson.A{"$duration", query.DurationMax.Microseconds()}}})
+	}
+	return bson.D{{Key: "$and", Value: conditions}}
+}
+
+func startTimeRange(query *spanstore.TraceQueryParameters) bson.D {
+	return bson.D{
+		{Key: "$gt", Value: query.StartTimeMin},
+		{Key: "$lt", Value: query.StartTimeMax},
+	}
+}
+
+// tagFields are the key-value arrays of a span that the tags of a query are
+// matched against, like the other Jaeger backends do.
+var tagFields = []string{"tags", "process.tags", "logs.fields"}
+
+// tagFilter returns the predicate of a tag of the query, which matches the
+// span tags, the process tags or the fields of any log of a span.
+func tagFilter(k, v string) bson.D {
+	match := bson.D{
+		{Key: "key", Value: k},
+		{Key: "value", Value: bson.D{{Key: "$in", Value: tagValueCandidates(v)}}},
+	}
+	fields := bson.A{}
+	for _, field := range tagFields {
+		fields = append(fields, bson.D{{Key: field, Value: bson.D{{Key: "$elemMatch", Value: match}}}})
+	}
+	return bson.D{{Key: "$or", Value: fields}}
 }
 
-func toStringOperations(arr []interface{}) ([]spanstore.Operation, error) {
-	array := make([]spanstore.Operation, len(arr))
+// tagExpr is the aggregation expression equivalent of tagFilter.
+func tagExpr(k, v string) bson.D {
+	logFields := bson.D{{Key: "$reduce", Value: bson.D{
+		{Key: "input", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$logs", bson.A{}}}}},
+		{Key: "initialValue", Value: bson.A{}},
+		{Key: "in", Value: bson.D{{Key: "$concatArrays", Value: bson.A{
+			"$$value",
+			bson.D{{Key: "$ifNull", Value: bson.A{"$$this.fields", bson.A{}}}},
+		}}}},
+	}}}
+	keyValues := bson.D{{Key: "$concatArrays", Value: bson.A{
+		bson.D{{Key: "$ifNull", Value: bson.A{"$tags", bson.A{}}}},
+		bson.D{{Key: "$ifNull", Value: bson.A{"$process.tags", bson.A{}}}},
+		logFields,
+	}}}
+	return bson.D{{Key: "$anyElementTrue", Value: bson.A{bson.D{{Key: "$map", Value: bson.D{
+		{Key: "input", Value: keyValues},
+		{Key: "as", Value: "tag"},
+		{Key: "in", Value: bson.D{{Key: "$and", Value: bson.A{
+			bson.D{{Key: "$eq", Value: bson.A{"$$tag.key", k}}},
+			bson.D{{Key: "$in", Value: bson.A{"$$tag.value", tagValueCandidates(v)}}},
+		}}}},
+	}}}}}}
+}
+
+// sortedTagKeys returns the keys of the tags of a query, sorted so that the
+// same query always has the same shape.
+func sortedTagKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func toStringArray(arr []interface{}) ([]string, error) {
+	array := make([]string, len(arr))
 
 	for i, s := range arr {
 		str, ok := s.(string)
 		if !ok {
 			return nil, errors.New("non-string key found")
 		}
-		array[i] = spanstore.Operation{
-			Name:     str,
-			SpanKind: "TODO",
-		}
+		array[i] = str
 	}
 
 	return array, nil
@@ -462,6 +989,21 @@ func (s *SpanReader) convertRefs(refs []Reference) ([]model.SpanRef, error) {
 	return retMe, nil
 }
 
+func (s *SpanReader) convertLogs(logs []Log) ([]model.Log, error) {
+	retMe := make([]model.Log, len(logs))
+	for i, l := range logs {
+		fields, err := s.convertKeyValues(l.Fields)
+		if err != nil {
+			return nil, err
+		}
+		retMe[i] = model.Log{
+			Timestamp: model.EpochMicrosecondsAsTime(l.Timestamp),
+			Fields:    fields,
+		}
+	}
+	return retMe, nil
+}
+
 func (s *SpanReader) convertKeyValues(tags []KeyValue) ([]model.KeyValue, error) {
 	retMe := make([]model.KeyValue, len(tags))
 	for i := range tags {
@@ -478,10 +1020,40 @@ func (s *SpanReader) convertKeyValue(tag *KeyValue) (model.KeyValue, error) {
 	if tag.Value == nil {
 		return model.KeyValue{}, fmt.Errorf("invalid nil Value in %v", tag)
 	}
-	tagValue, ok := tag.Value.(string)
-	if !ok {
-		return model.KeyValue{}, fmt.Errorf("non-string Value of type %t in %v", tag.Value, tag)
+	// Older versions of the plugin stored every value as a string.
+	if tagValue, ok := tag.Value.(string); ok {
+		return s.convertLegacyKeyValue(tag, tagValue)
+	}
+	switch tag.Type {
+	case StringType:
+		return model.KeyValue{}, fmt.Errorf("invalid value of tag %q: expected string, found %T", tag.Key, tag.Value)
+	case BoolType:
+		if value, ok := tag.Value.(bool); ok {
+			return model.Bool(tag.Key, value), nil
+		}
+	case Int64Type:
+		switch value := tag.Value.(type) {
+		case int64:
+			return model.Int64(tag.Key, value), nil
+		case int32:
+			return model.Int64(tag.Key, int64(value)), nil
+		}
+	case Float64Type:
+		if value, ok := tag.Value.(float64); ok {
+			return model.Float64(tag.Key, value), nil
+		}
+	case BinaryType:
+		if value, ok := tag.Value.(primitive.Binary); ok {
+			return model.Binary(tag.Key, value.Data), nil
+		}
+	default:
+		return model.KeyValue{}, fmt.Errorf("not a valid ValueType string %s", string(tag.Type))
 	}
+	return model.KeyValue{}, fmt.Errorf("unexpected Value of type %T for ValueType %s in %v", tag.Value, string(tag.Type), tag)
+}
+
+// convertLegacyKeyValue parses a value stored in its string representation.
+func (s *SpanReader) convertLegacyKeyValue(tag *KeyValue, tagValue string) (model.KeyValue, error) {
 	switch tag.Type {
 	case StringType:
 		return model.String(tag.Key, tagValue), nil
@@ -506,3 +1078,19 @@ func (s *SpanReader) convertKeyValue(tag *KeyValue) (model.KeyValue, error) {
 	}
 	return model.KeyValue{}, fmt.Errorf("not a valid ValueType string %s", string(tag.Type))
 }
+
+// tagValueCandidates returns every stored representation a tag value given as
+// a query string may have: the string itself, which also covers values stored
+// by older versions of the plugin, and its native BSON number or boolean.
+func tagValueCandidates(v string) bson.A {
+	candidates := bson.A{v}
+	if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+		candidates = append(candidates, i)
+	} else if f, err := strconv.ParseFloat(v, 64); err == nil {
+		candidates = append(candidates, f)
+	}
+	if v == "true" || v == "false" {
+		candidates = append(candidates, v == "true")
+	}
+	return candidates
+}
@@ -0,0 +1,117 @@
+package jaeger_mongodb
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrPerServiceTimeSeries is returned for per-service retention in the
+// time-series layout, whose collection expires all documents alike.
+var ErrPerServiceTimeSeries = errors.New("per-service retention is not supported in the time-series layout")
+
+// Retention decides how long the spans of each service are kept.
+type Retention struct {
+	ttl      time.Duration
+	services map[string]time.Duration
+	patterns []servicePattern
+}
+
+// servicePattern is the retention of the services matching a glob.
+type servicePattern struct {
+	glob string
+	ttl  time.Duration
+}
+
+// NewRetention returns the Retention which keeps the spans of the services
+// named in services, or matching a glob such as "health-*" in it, for the
+// given duration, and those of other services for ttl. Services are matched
+// case-insensitively, since configuration keys are not case-sensitive. A
+// service matching several globs gets the retention of the longest one.
+func NewRetention(ttl time.Duration, services map[string]string) (*Retention, error) {
+	r := &Retention{ttl: ttl, services: make(map[string]time.Duration)}
+	for service, s := range services {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention %q of service %q: %w", s, service, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid retention %q of service %q: must be positive", s, service)
+		}
+		service = strings.ToLower(service)
+		if _, err := path.Match(service, ""); err != nil {
+			return nil, fmt.Errorf("invalid service pattern %q: %w", service, err)
+		}
+		if strings.ContainsAny(service, `*?[\`) {
+			r.patterns = append(r.patterns, servicePattern{glob: service, ttl: d})
+		} else {
+			r.services[service] = d
+		}
+	}
+	sort.Slice(r.patterns, func(i, j int) bool {
+		if len(r.patterns[i].glob) != len(r.patterns[j].glob) {
+			return len(r.patterns[i].glob) > len(r.patterns[j].glob)
+		}
+		return r.patterns[i].glob < r.patterns[j].glob
+	})
+	return r, nil
+}
+
+// PerService reports whether any service has its own retention.
+func (r *Retention) PerService() bool {
+	return len(r.services) != 0 || len(r.patterns) != 0
+}
+
+// TTL returns how long the spans of the service are kept.
+func (r *Retention) TTL(service string) time.Duration {
+	service = strings.ToLower(service)
+	if ttl, ok := r.services[service]; ok {
+		return ttl
+	}
+	for _, p := range r.patterns {
+		if ok, _ := path.Match(p.glob, service); ok {
+			return p.ttl
+		}
+	}
+	return r.ttl
+}
+
+// Max returns the longest retention of any service, which the TTL indexes on
+// startTime enforce for documents written without an expireAt date.
+func (r *Retention) Max() time.Duration {
+	longest := r.ttl
+	for _, ttl := range r.services {
+		if ttl > longest {
+			longest = ttl
+		}
+	}
+	for _, p := range r.patterns {
+		if p.ttl > longest {
+			longest = p.ttl
+		}
+	}
+	return longest
+}
+
+// ExpireAt returns when the span expires.
+func (r *Retention) ExpireAt(mSpan *Span) time.Time {
+	return mSpan.StartTime.Add(r.TTL(mSpan.Process.ServiceName))
+}
+
+// ExpireAtIndex returns the TTL index which deletes span and trace documents
+// at their expireAt date. Documents without one are left to the TTLIndex.
+func ExpireAtIndex() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.D{{Key: "expireAt", Value: 1}},
+		Options: options.Index().
+			SetName("ExpireAtIndex").
+			SetExpireAfterSeconds(0),
+	}
+}
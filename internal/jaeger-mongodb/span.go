@@ -28,21 +28,34 @@ const (
 	Int64Type ValueType = "int64"
 	// Float64Type indicates a 64bit float value stored in KeyValue
 	Float64Type ValueType = "float64"
+	// BinaryType indicates an arbitrary byte array stored in KeyValue
+	BinaryType ValueType = "binary"
 )
 
+// SchemaVersion is the version of the span documents written by this version
+// of the plugin. Documents without a schemaVersion field are version 0, which
+// stored every tag value as a string and had no spanKind field. Documents of
+// older versions are still read, and Migrator upgrades them.
+const SchemaVersion = 1
+
 // Span is MongoDB representation of the domain span.
 type Span struct {
+	ID            interface{} `bson:"_id,omitempty"` // see spanDocumentID
+	SchemaVersion int         `bson:"schemaVersion,omitempty"`
 	TraceID       string      `bson:"traceID"`
 	SpanID        string      `bson:"spanID"`
 	OperationName string      `bson:"operationName"`
+	SpanKind      string      `bson:"spanKind"`  // value of the span.kind tag
 	StartTime     time.Time   `bson:"startTime"` // microseconds since Unix epoch
 	Duration      int64       `bson:"duration"`  // microseconds
+	Flags         uint32      `bson:"flags"`
 	References    []Reference `bson:"references"`
 	ProcessID     string      `bson:"processID"`
 	Process       Process     `bson:"process,omitempty"`
 	Tags          []KeyValue  `bson:"tags"`
 	Logs          []Log       `bson:"logs"`
 	Warnings      []string    `bson:"warnings"`
+	ExpireAt      time.Time   `bson:"expireAt,omitempty"` // see Retention
 }
 
 // Reference is a reference from one span to another
@@ -0,0 +1,242 @@
+package jaeger_mongodb
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Layout is how spans are stored in the spans collection.
+type Layout string
+
+const (
+	// LayoutSpan stores every span as its own document.
+	LayoutSpan Layout = "span"
+	// LayoutTrace stores all spans of a trace in one TraceDocument.
+	LayoutTrace Layout = "trace"
+	// LayoutTimeSeries stores every span as its own document in a
+	// time-series collection, see CreateTimeSeriesCollection.
+	LayoutTimeSeries Layout = "timeseries"
+)
+
+// ParseLayout returns the Layout named s.
+func ParseLayout(s string) (Layout, error) {
+	switch layout := Layout(s); layout {
+	case LayoutSpan, LayoutTrace, LayoutTimeSeries:
+		return layout, nil
+	default:
+		return "", fmt.Errorf("invalid layout %q, expected %q, %q or %q", s, LayoutSpan, LayoutTrace, LayoutTimeSeries)
+	}
+}
+
+// TraceDocument is the MongoDB representation of a trace in the trace
+// layout. Spans are pushed into it as they are written, which keeps the
+// summary fields up to date. A trace document is limited to the 16MB of any
+// MongoDB document.
+type TraceDocument struct {
+	TraceID       string    `bson:"_id"`
+	RootService   string    `bson:"rootService,omitempty"`
+	RootOperation string    `bson:"rootOperation,omitempty"`
+	StartTime     time.Time `bson:"startTime"` // of the earliest span
+	EndTime       time.Time `bson:"endTime"`   // of the latest span to finish
+	SpanCount     int64     `bson:"spanCount"`
+	Error         bool      `bson:"error"`              // whether a span has the error tag
+	ExpireAt      time.Time `bson:"expireAt,omitempty"` // of the span kept longest
+	Spans         []Span    `bson:"spans"`
+}
+
+// isRootSpan reports whether the span has no parent in its trace.
+func isRootSpan(mSpan *Span) bool {
+	for _, ref := range mSpan.References {
+		if string(ref.TraceID) == mSpan.TraceID {
+			return false
+		}
+	}
+	return true
+}
+
+// isErrorSpan reports whether the span has the error tag set.
+func isErrorSpan(mSpan *Span) bool {
+	for _, kv := range mSpan.Tags {
+		if kv.Key == "error" && (kv.Value == true || kv.Value == "true") {
+			return true
+		}
+	}
+	return false
+}
+
+// traceSpanUpdate returns the upsert which adds the span to the document of
+// its trace and updates the summary fields. The filter does not match a
+// document that already holds the span, so the upsert then fails with a
+// duplicate key error instead of adding the span twice.
+func traceSpanUpdate(mSpan *Span) (bson.D, bson.D) {
+	filter := bson.D{
+		{Key: "_id", Value: mSpan.TraceID},
+		{Key: "spans._id", Value: bson.D{{Key: "$ne", Value: mSpan.ID}}},
+	}
+	end := mSpan.StartTime.Add(time.Duration(mSpan.Duration) * time.Microsecond)
+	maxes := bson.D{
+		{Key: "endTime", Value: end},
+		{Key: "error", Value: isErrorSpan(mSpan)},
+	}
+	if !mSpan.ExpireAt.IsZero() {
+		// The trace is kept as long as any of its spans.
+		maxes = append(maxes, bson.E{Key: "expireAt", Value: mSpan.ExpireAt})
+	}
+	update := bson.D{
+		{Key: "$push", Value: bson.D{{Key: "spans", Value: mSpan}}},
+		{Key: "$min", Value: bson.D{{Key: "startTime", Value: mSpan.StartTime}}},
+		{Key: "$max", Value: maxes},
+		{Key: "$inc", Value: bson.D{{Key: "spanCount", Value: 1}}},
+	}
+	if isRootSpan(mSpan) {
+		update = append(update, bson.E{Key: "$set", Value: bson.D{
+			{Key: "rootService", Value: mSpan.Process.ServiceName},
+			{Key: "rootOperation", Value: mSpan.OperationName},
+		}})
+	}
+	return filter, update
+}
+
+// writeTraceSpan adds the span to the document of its trace.
+func (s *SpanWriter) writeTraceSpan(ctx context.Context, mSpan *Span) error {
+	filter, update := traceSpanUpdate(mSpan)
+	opts := options.Update().SetUpsert(true)
+	_, err := s.collection.UpdateOne(ctx, filter, update, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		// Either the span was already written or a concurrent upsert
+		// inserted the trace document first. Only in the latter case does
+		// the filter match on a second attempt.
+		_, err = s.collection.UpdateOne(ctx, filter, update, opts)
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// spanStages returns the stages that pass on the spans matching filter as
+// span documents, whatever the layout.
+func spanStages(layout Layout, filter bson.D) mongo.Pipeline {
+	if layout != LayoutTrace {
+		return mongo.Pipeline{{{Key: "$match", Value: filter}}}
+	}
+	return mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "spans", Value: bson.D{{Key: "$elemMatch", Value: filter}}}}}},
+		{{Key: "$unwind", Value: "$spans"}},
+		{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: "$spans"}}}},
+		{{Key: "$match", Value: filter}},
+	}
+}
+
+// traceDocumentsPipeline is the trace layout equivalent of the $match and
+// $group stages of findTraceIDs. The trace documents are matched directly, so
+// the traces are ordered by the start of the trace rather than of the most
+// recent matching span.
+func traceDocumentsPipeline(query *spanstore.TraceQueryParameters, mode TagMatchMode) mongo.Pipeline {
+	var filter bson.D
+	if mode == TagMatchTrace && len(query.Tags) != 0 {
+		spanQuery := *query
+		spanQuery.Tags = nil
+		conditions := bson.A{
+			bson.D{{Key: "spans", Value: bson.D{{Key: "$elemMatch", Value: spanFilter(&spanQuery)}}}},
+		}
+		for _, k := range sortedTagKeys(query.Tags) {
+			match := append(bson.D{{Key: "startTime", Value: startTimeRange(query)}}, tagFilter(k, query.Tags[k])...)
+			conditions = append(conditions, bson.D{{Key: "spans", Value: bson.D{{Key: "$elemMatch", Value: match}}}})
+		}
+		filter = bson.D{{Key: "$and", Value: conditions}}
+	} else {
+		filter = bson.D{{Key: "spans", Value: bson.D{{Key: "$elemMatch", Value: spanFilter(query)}}}}
+	}
+	// A trace cannot have a span in the range unless it started before its
+	// end, which lets the startTime index narrow the search.
+	filter = append(bson.D{{Key: "startTime", Value: bson.D{{Key: "$lt", Value: query.StartTimeMax}}}}, filter...)
+
+	return mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$project", Value: bson.D{{Key: "startTime", Value: 1}}}},
+	}
+}
+
+// traceDependencyLinksPipeline is the trace layout equivalent of
+// dependencyLinksPipeline. Parent spans are looked up in the document of the
+// child's trace, so references to spans of other traces are not counted.
+func traceDependencyLinksPipeline(start, end time.Time) mongo.Pipeline {
+	return append(mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"spans": bson.M{"$elemMatch": bson.M{
+			"startTime":          bson.M{"$gte": start, "$lt": end},
+			"references.refType": ChildOf,
+		}}}}},
+	}, traceLinksStages(start, end)...)
+}
+
+// timeSeriesDependencyLinksPipeline is the time-series layout equivalent of
+// dependencyLinksPipeline, which avoids a $lookup into the time-series
+// collection by grouping the spans started in [start, end) by trace. Only
+// parent spans started in the same interval are found. Time-series
+// collections do not enforce unique _ids, so spans written twice are
+// deduplicated by _id first.
+func timeSeriesDependencyLinksPipeline(start, end time.Time) mongo.Pipeline {
+	return append(mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"startTime": bson.M{"$gte": start, "$lt": end}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":  "$_id",
+			"span": bson.M{"$first": "$$ROOT"},
+		}}},
+		{{Key: "$replaceRoot", Value: bson.M{"newRoot": "$span"}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$traceID",
+			"spans": bson.M{"$push": "$$ROOT"},
+		}}},
+	}, traceLinksStages(start, end)...)
+}
+
+// traceLinksStages counts the dependency links between the spans of each
+// trace document started in [start, end).
+func traceLinksStages(start, end time.Time) mongo.Pipeline {
+	startTime := bson.M{"$gte": start, "$lt": end}
+	return mongo.Pipeline{
+		{{Key: "$project", Value: bson.M{"_id": 0, "spans": 1, "child": "$spans"}}},
+		{{Key: "$unwind", Value: "$child"}},
+		{{Key: "$match", Value: bson.M{"child.startTime": startTime}}},
+		{{Key: "$unwind", Value: "$child.references"}},
+		{{Key: "$match", Value: bson.M{"child.references.refType": ChildOf}}},
+		{{Key: "$project", Value: bson.M{
+			"child": "$child.process.serviceName",
+			"parent": bson.M{"$arrayElemAt": bson.A{
+				bson.M{"$filter": bson.M{
+					"input": "$spans",
+					"cond":  bson.M{"$eq": bson.A{"$$this.spanID", "$child.references.spanID"}},
+				}},
+				0,
+			}},
+		}}},
+		{{Key: "$match", Value: bson.M{"parent": bson.M{"$exists": true}}}},
+		{{Key: "$match", Value: bson.M{"$expr": bson.M{"$ne": bson.A{"$parent.process.serviceName", "$child"}}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"parent": "$parent.process.serviceName",
+				"child":  "$child",
+			},
+			"callCount": bson.M{"$sum": 1},
+		}}},
+	}
+}
+
+// linksPipeline returns the dependency links pipeline of the layout.
+func linksPipeline(layout Layout, collection string, start, end time.Time) mongo.Pipeline {
+	switch layout {
+	case LayoutTrace:
+		return traceDependencyLinksPipeline(start, end)
+	case LayoutTimeSeries:
+		return timeSeriesDependencyLinksPipeline(start, end)
+	default:
+		return dependencyLinksPipeline(collection, start, end)
+	}
+}
@@ -2,55 +2,202 @@ package jaeger_mongodb
 
 import (
 	"context"
+	"fmt"
+	"hash/fnv"
 	"strings"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type SpanWriter struct {
-	collection *mongo.Collection
-	log        hclog.Logger
+	collection         *mongo.Collection
+	log                hclog.Logger
+	maxBinaryValueSize int
+	// upsert replaces an already stored span with the same traceID and spanID
+	// instead of inserting a new document.
+	upsert bool
+	// catalog records the operations of written spans, if not nil.
+	catalog *operationCatalog
+	layout  Layout
+	// retention stamps an expireAt date on written spans, if not nil.
+	retention *Retention
 }
 
-func NewSpanWriter(collection *mongo.Collection, logger hclog.Logger) *SpanWriter {
+// NewSpanWriter returns a SpanWriter storing spans in the given collection.
+// Binary tag values longer than maxBinaryValueSize bytes are truncated; a
+// maxBinaryValueSize of 0 disables truncation.
+func NewSpanWriter(collection *mongo.Collection, logger hclog.Logger, maxBinaryValueSize int) *SpanWriter {
 	return &SpanWriter{
-		collection: collection,
-		log:        logger,
+		collection:         collection,
+		log:                logger,
+		maxBinaryValueSize: maxBinaryValueSize,
+		layout:             LayoutSpan,
 	}
 }
 
+// NewArchiveSpanWriter returns a SpanWriter for the archive collection.
+// Archiving a span that is already archived replaces it, so archiving the
+// same trace repeatedly never creates duplicates.
+func NewArchiveSpanWriter(collection *mongo.Collection, logger hclog.Logger, maxBinaryValueSize int) *SpanWriter {
+	w := NewSpanWriter(collection, logger, maxBinaryValueSize)
+	w.upsert = true
+	return w
+}
+
+// WithCatalog makes the writer record the service and operation of every
+// written span in the given catalog collection.
+func (s *SpanWriter) WithCatalog(collection *mongo.Collection) *SpanWriter {
+	s.catalog = newOperationCatalog(collection)
+	return s
+}
+
+// WithLayout sets the Layout in which spans are stored. The archive writer
+// always stores spans in the span layout.
+func (s *SpanWriter) WithLayout(layout Layout) *SpanWriter {
+	if !s.upsert {
+		s.layout = layout
+	}
+	return s
+}
+
+// WithRetention makes the writer stamp every span with the expireAt date
+// of its service's retention, enforced by the ExpireAtIndex. Archived spans
+// never expire, so the archive writer ignores it.
+func (s *SpanWriter) WithRetention(retention *Retention) *SpanWriter {
+	if !s.upsert {
+		s.retention = retention
+	}
+	return s
+}
+
 // Write a span into MongoDB.
 func (s *SpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	mSpan, err := s.convertSpan(span)
+	if err != nil {
+		return err
+	}
+	if s.layout == LayoutTrace {
+		if err := s.writeTraceSpan(ctx, &mSpan); err != nil {
+			return err
+		}
+		return s.recordOperation(ctx, &mSpan)
+	}
+	b, err := bson.Marshal(mSpan)
+
+	if err != nil {
+		return err
+	}
+	if s.upsert {
+		filter := bson.D{
+			{Key: "traceID", Value: mSpan.TraceID},
+			{Key: "spanID", Value: mSpan.SpanID},
+		}
+		_, err = s.collection.ReplaceOne(ctx, filter, b, options.Replace().SetUpsert(true))
+		return err
+	}
+	_, err = s.collection.InsertOne(ctx, b)
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return err
+	}
+	// A duplicate key error means the span was already written, e.g. by a
+	// retried request.
+	return s.recordOperation(ctx, &mSpan)
+}
+
+// writeModel returns the write of the span for a bulk write. Like WriteSpan,
+// it fails with a duplicate key error if the span was already written.
+func (s *SpanWriter) writeModel(mSpan *Span) mongo.WriteModel {
+	if s.layout == LayoutTrace {
+		filter, update := traceSpanUpdate(mSpan)
+		return mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true)
+	}
+	return mongo.NewInsertOneModel().SetDocument(mSpan)
+}
+
+func (s *SpanWriter) recordOperation(ctx context.Context, mSpan *Span) error {
+	if s.catalog == nil {
+		return nil
+	}
+	if err := s.catalog.record(ctx, mSpan); err != nil {
+		return fmt.Errorf("error recording operation in catalog: %w", err)
+	}
+	return nil
+}
+
+// spanDocumentID derives the _id of a span document from its traceID, spanID
+// and a hash of the domain span, so that writing the same span again fails
+// with a duplicate key error instead of creating a second document. Distinct
+// spans sharing a spanID, such as Zipkin-style shared spans, are all kept.
+// The hash covers the span as received rather than as stored, so the _id
+// survives configuration changes such as the truncation of binary values,
+// retentions and new schema versions.
+func spanDocumentID(span *model.Span) (string, error) {
+	b, err := span.Marshal()
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New64a()
+	h.Write(b)
+	return fmt.Sprintf("%s-%s-%016x", span.TraceID, span.SpanID, h.Sum64()), nil
+}
+
+// convertSpan converts the domain span to its MongoDB representation.
+func (s *SpanWriter) convertSpan(span *model.Span) (Span, error) {
+	tags, tagWarnings := s.convertKeyValues(span.Tags)
+	process, processWarnings := s.convertProcess(span.Process)
+	logs, logWarnings := s.convertLogs(span.Logs)
+
+	warnings := span.Warnings
+	if len(tagWarnings)+len(processWarnings)+len(logWarnings) > 0 {
+		// Copy so that the caller's span is left untouched.
+		warnings = append([]string{}, span.Warnings...)
+		warnings = append(warnings, tagWarnings...)
+		warnings = append(warnings, processWarnings...)
+		warnings = append(warnings, logWarnings...)
+	}
+
 	mSpan := Span{
+		SchemaVersion: SchemaVersion,
 		TraceID:       span.TraceID.String(),
 		SpanID:        span.SpanID.String(),
 		OperationName: span.OperationName,
 		StartTime:     span.StartTime,
 		Duration:      span.Duration.Microseconds(),
+		Flags:         uint32(span.Flags),
 		References:    convertReferences(span),
 		ProcessID:     span.ProcessID,
-		Process:       convertProcess(span.Process),
-		Tags:          convertKeyValues(span.Tags),
-		//Logs:          nil,
-		Warnings: span.Warnings,
+		Process:       process,
+		Tags:          tags,
+		Logs:          logs,
+		Warnings:      warnings,
 	}
-	b, err := bson.Marshal(mSpan)
-
+	mSpan.SpanKind = spanKind(&mSpan)
+	if s.retention != nil {
+		mSpan.ExpireAt = s.retention.ExpireAt(&mSpan)
+	}
+	if s.upsert {
+		// Archived spans are replaced by traceID and spanID, and the _id of
+		// a document cannot change, so leave it to MongoDB.
+		return mSpan, nil
+	}
+	id, err := spanDocumentID(span)
 	if err != nil {
-		return err
+		return Span{}, err
 	}
-	_, err = s.collection.InsertOne(ctx, b)
-	return err
+	mSpan.ID = id
+	return mSpan, nil
 }
 
-func convertProcess(process *model.Process) Process {
+func (s *SpanWriter) convertProcess(process *model.Process) (Process, []string) {
+	tags, warnings := s.convertKeyValues(process.Tags)
 	return Process{
 		ServiceName: process.ServiceName,
-		Tags:        convertKeyValues(process.Tags),
-	}
+		Tags:        tags,
+	}, warnings
 }
 
 func convertReferences(span *model.Span) []Reference {
@@ -72,20 +219,71 @@ func convertRefType(refType model.SpanRefType) ReferenceType {
 	return ChildOf
 }
 
-func convertKeyValues(keyValues model.KeyValues) []KeyValue {
+func (s *SpanWriter) convertLogs(logs []model.Log) ([]Log, []string) {
+	out := make([]Log, 0, len(logs))
+	var warnings []string
+	for _, l := range logs {
+		fields, fieldWarnings := s.convertKeyValues(l.Fields)
+		warnings = append(warnings, fieldWarnings...)
+		out = append(out, Log{
+			Timestamp: model.TimeAsEpochMicroseconds(l.Timestamp),
+			Fields:    fields,
+		})
+	}
+	return out, warnings
+}
+
+// convertKeyValues converts the key values to their MongoDB representation,
+// returning a warning for every binary value that had to be truncated.
+func (s *SpanWriter) convertKeyValues(keyValues model.KeyValues) ([]KeyValue, []string) {
 	kvs := make([]KeyValue, 0)
+	var warnings []string
 	for _, kv := range keyValues {
-		if kv.GetVType() != model.BinaryType {
-			kvs = append(kvs, convertKeyValue(kv))
+		if kv.GetVType() == model.BinaryType {
+			value := kv.Binary()
+			if s.maxBinaryValueSize > 0 && len(value) > s.maxBinaryValueSize {
+				warnings = append(warnings, fmt.Sprintf("binary value of %q truncated from %d to %d bytes", kv.Key, len(value), s.maxBinaryValueSize))
+				value = value[:s.maxBinaryValueSize]
+			}
+			kvs = append(kvs, KeyValue{
+				Key:   kv.Key,
+				Type:  BinaryType,
+				Value: value,
+			})
+			continue
 		}
+		kvs = append(kvs, convertKeyValue(kv))
 	}
-	return kvs
+	return kvs, warnings
 }
 
 func convertKeyValue(kv model.KeyValue) KeyValue {
+	var value interface{}
+	switch kv.GetVType() {
+	case model.BoolType:
+		value = kv.Bool()
+	case model.Int64Type:
+		value = kv.Int64()
+	case model.Float64Type:
+		value = kv.Float64()
+	default:
+		value = kv.AsString()
+	}
 	return KeyValue{
 		Key:   kv.Key,
 		Type:  ValueType(strings.ToLower(kv.VType.String())),
-		Value: kv.AsString(),
+		Value: value,
+	}
+}
+
+// spanKind returns the value of the span.kind tag, or "" if it has none.
+func spanKind(mSpan *Span) string {
+	for _, tag := range mSpan.Tags {
+		if tag.Key == "span.kind" {
+			if kind, ok := tag.Value.(string); ok {
+				return kind
+			}
+		}
 	}
+	return ""
 }
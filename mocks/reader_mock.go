@@ -36,6 +36,21 @@ func (m *MockReaderStorage) EXPECT() *MockReaderStorageMockRecorder {
 	return m.recorder
 }
 
+// Aggregate mocks base method.
+func (m *MockReaderStorage) Aggregate(ctx context.Context, pipeline interface{}, opts *options.AggregateOptions) (*mongo.Cursor, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Aggregate", ctx, pipeline, opts)
+	ret0, _ := ret[0].(*mongo.Cursor)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Aggregate indicates an expected call of Aggregate.
+func (mr *MockReaderStorageMockRecorder) Aggregate(ctx, pipeline, opts interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Aggregate", reflect.TypeOf((*MockReaderStorage)(nil).Aggregate), ctx, pipeline, opts)
+}
+
 // Distinct mocks base method.
 func (m *MockReaderStorage) Distinct(ctx context.Context, field string, filter interface{}, opts *options.DistinctOptions) ([]interface{}, error) {
 	m.ctrl.T.Helper()
@@ -65,3 +80,17 @@ func (mr *MockReaderStorageMockRecorder) Find(ctx, filter, opts interface{}) *go
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Find", reflect.TypeOf((*MockReaderStorage)(nil).Find), ctx, filter, opts)
 }
+
+// Name mocks base method.
+func (m *MockReaderStorage) Name() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Name")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// Name indicates an expected call of Name.
+func (mr *MockReaderStorageMockRecorder) Name() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Name", reflect.TypeOf((*MockReaderStorage)(nil).Name))
+}
@@ -0,0 +1,379 @@
+package jaeger_mongodb_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+
+	jaeger_mongodb "jaeger-mongodb/internal/jaeger-mongodb"
+)
+
+// recordingStorage records the last command sent by the reader so that its
+// query plan can be explained.
+type recordingStorage struct {
+	*jaeger_mongodb.MongoReaderStorage
+	command bson.D
+}
+
+func (r *recordingStorage) Aggregate(ctx context.Context, pipeline interface{}, opts *options.AggregateOptions) (*mongo.Cursor, error) {
+	r.command = bson.D{
+		{Key: "aggregate", Value: r.Name()},
+		{Key: "pipeline", Value: pipeline},
+		{Key: "cursor", Value: bson.D{}},
+	}
+	return r.MongoReaderStorage.Aggregate(ctx, pipeline, opts)
+}
+
+func (r *recordingStorage) Find(ctx context.Context, filter interface{}, opts *options.FindOptions) (*mongo.Cursor, error) {
+	r.command = bson.D{
+		{Key: "find", Value: r.Name()},
+		{Key: "filter", Value: filter},
+	}
+	return r.MongoReaderStorage.Find(ctx, filter, opts)
+}
+
+// winningIndexes returns the names of the indexes scanned by the winning plan
+// of an explain output.
+func winningIndexes(v interface{}, inWinningPlan bool, names map[string]struct{}) {
+	visit := func(key string, value interface{}) {
+		if inWinningPlan && key == "indexName" {
+			names[fmt.Sprint(value)] = struct{}{}
+		}
+		winningIndexes(value, inWinningPlan || key == "winningPlan", names)
+	}
+	switch v := v.(type) {
+	case bson.D:
+		for _, e := range v {
+			visit(e.Key, e.Value)
+		}
+	case bson.M:
+		for k, value := range v {
+			visit(k, value)
+		}
+	case bson.A:
+		for _, value := range v {
+			winningIndexes(value, inWinningPlan, names)
+		}
+	}
+}
+
+func connectIT(t *testing.T) *mongo.Client {
+	mongoURL := os.Getenv("MONGO_URL")
+	if mongoURL == "" {
+		t.Skip("set MONGO_URL to run the IT tests")
+	}
+	m, err := mongo.Connect(context.TODO(), options.Client().
+		ApplyURI(mongoURL).
+		SetWriteConcern(writeconcern.New(writeconcern.W(1))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestIndexesIntegration(t *testing.T) {
+	m := connectIT(t)
+	ctx := context.Background()
+	db := m.Database("jaeger-indexes-test")
+	defer func() {
+		db.Drop(ctx)
+		m.Disconnect(ctx)
+	}()
+
+	collection := db.Collection("spans")
+	indexes := jaeger_mongodb.SpanIndexes(time.Hour)
+
+	// TagsIndex as created before the case of its service name was fixed.
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "process.ServiceName", Value: 1},
+			{Key: "operationName", Value: 1},
+			{Key: "tags.key", Value: 1},
+			{Key: "tags.value", Value: 1},
+			{Key: "startTime", Value: -1},
+		},
+		Options: options.Index().SetName("TagsIndex"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "custom", Value: 1}},
+		Options: options.Index().SetName("CustomIndex"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := jaeger_mongodb.CompareIndexes(ctx, collection, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, diff.Diverged())
+	assert.Equal(t, []string{"TagsIndex"}, diff.Changed)
+	assert.Equal(t, []string{"CustomIndex"}, diff.Unexpected)
+	assert.Equal(t, len(indexes)-1, len(diff.Missing))
+
+	assert.Equal(t, []string{"TagsIndex"}, diff.Rebuild)
+
+	// Only the missing indexes are created.
+	created, err := jaeger_mongodb.CreateIndexes(ctx, collection, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(indexes)-1, len(created))
+	diff, err = jaeger_mongodb.CompareIndexes(ctx, collection, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"TagsIndex"}, diff.Changed)
+
+	rebuilt, err := jaeger_mongodb.RebuildIndexes(ctx, collection, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"TagsIndex"}, rebuilt)
+	diff, err = jaeger_mongodb.CompareIndexes(ctx, collection, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, diff.Diverged(), diff.String())
+
+	// A changed TTL is reported but the index is not rebuilt.
+	indexes = jaeger_mongodb.SpanIndexes(2 * time.Hour)
+	created, err = jaeger_mongodb.CreateIndexes(ctx, collection, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, created)
+	diff, err = jaeger_mongodb.CompareIndexes(ctx, collection, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"TTLIndex"}, diff.Changed)
+	assert.Equal(t, []jaeger_mongodb.TTLChange{{
+		Collection: "spans",
+		Index:      "TTLIndex",
+		Old:        time.Hour,
+		New:        2 * time.Hour,
+	}}, diff.TTLChanges)
+
+	// It is applied with collMod.
+	if err := jaeger_mongodb.UpdateTTL(ctx, db, diff.TTLChanges[0]); err != nil {
+		t.Fatal(err)
+	}
+	diff, err = jaeger_mongodb.CompareIndexes(ctx, collection, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, diff.Diverged(), diff.String())
+}
+
+func TestQueryPlansIntegration(t *testing.T) {
+	m := connectIT(t)
+	ctx := context.Background()
+	db := m.Database("jaeger-query-plans-test")
+	defer func() {
+		db.Drop(ctx)
+		m.Disconnect(ctx)
+	}()
+
+	collection := db.Collection("spans")
+	if _, err := jaeger_mongodb.CreateIndexes(ctx, collection, jaeger_mongodb.SpanIndexes(time.Hour*24*365*10)); err != nil {
+		t.Fatal(err)
+	}
+	writer := jaeger_mongodb.NewSpanWriter(collection, nil, maxBinaryValueSize)
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2000; i++ {
+		span := &model.Span{
+			TraceID:       model.NewTraceID(0, uint64(i/4+1)),
+			SpanID:        model.NewSpanID(uint64(i + 1)),
+			OperationName: fmt.Sprintf("operation %d", i%10),
+			StartTime:     start.Add(time.Duration(i) * time.Second),
+			Duration:      time.Duration(i%200) * time.Millisecond,
+			Tags:          []model.KeyValue{model.Int64("http.status_code", int64(200+i%5))},
+			Process: &model.Process{
+				ServiceName: fmt.Sprintf("service %d", i%5),
+			},
+		}
+		if err := writer.WriteSpan(ctx, span); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storage := &recordingStorage{MongoReaderStorage: jaeger_mongodb.NewMongoReaderStorage(collection)}
+	reader := jaeger_mongodb.NewSpanReader(storage, nil, timeoutDuration)
+
+	testCases := []struct {
+		name    string
+		run     func() error
+		indexes []string
+	}{
+		{
+			name: "FindTraces by service and operation",
+			run: func() error {
+				_, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+					ServiceName:   "service 1",
+					OperationName: "operation 1",
+					StartTimeMin:  start,
+					StartTimeMax:  start.Add(time.Hour),
+					NumTraces:     20,
+				})
+				return err
+			},
+			indexes: []string{"ServiceNameAndOperationsIndex", "TagsIndex"},
+		},
+		{
+			name: "FindTraces by service and duration",
+			run: func() error {
+				_, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+					ServiceName:  "service 1",
+					StartTimeMin: start,
+					StartTimeMax: start.Add(time.Hour),
+					DurationMin:  190 * time.Millisecond,
+					DurationMax:  195 * time.Millisecond,
+					NumTraces:    20,
+				})
+				return err
+			},
+			indexes: []string{"ServiceNameAndDurationIndex"},
+		},
+		{
+			name: "FindTraces by service, operation and tag",
+			run: func() error {
+				_, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+					ServiceName:   "service 1",
+					OperationName: "operation 1",
+					StartTimeMin:  start,
+					StartTimeMax:  start.Add(time.Hour),
+					Tags:          map[string]string{"http.status_code": "201"},
+					NumTraces:     20,
+				})
+				return err
+			},
+			// The tag may also be a process tag or log field.
+			indexes: []string{"ServiceNameAndOperationsIndex", "TagsIndex", "ProcessTagsIndex", "LogFieldsIndex"},
+		},
+		{
+			name: "GetTrace",
+			run: func() error {
+				_, err := reader.GetTrace(ctx, model.NewTraceID(0, 1))
+				return err
+			},
+			indexes: []string{"TraceIDIndex"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.run(); err != nil {
+				t.Fatal(err)
+			}
+			var explain bson.M
+			err := db.RunCommand(ctx, bson.D{
+				{Key: "explain", Value: storage.command},
+				{Key: "verbosity", Value: "queryPlanner"},
+			}).Decode(&explain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := map[string]struct{}{}
+			winningIndexes(explain, false, names)
+			assert.NotEmpty(t, names, "the winning plan should scan an index")
+			for name := range names {
+				assert.Contains(t, tc.indexes, name)
+			}
+		})
+	}
+}
+
+func TestBootstrapIntegration(t *testing.T) {
+	m := connectIT(t)
+	ctx := context.Background()
+	db := m.Database("jaeger-bootstrap-test")
+	defer func() {
+		db.Drop(ctx)
+		m.Disconnect(ctx)
+	}()
+
+	config := jaeger_mongodb.Configuration{
+		MongoCollection:             "spans",
+		MongoArchiveCollection:      "archive",
+		MongoCatalogCollection:      "catalog",
+		MongoDependenciesCollection: "dependencies",
+		MongoSpanTTLDuration:        time.Hour,
+		MongoLayout:                 "span",
+		MongoSchemaValidation:       true,
+	}
+	changes, err := jaeger_mongodb.Bootstrap(ctx, db, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, changes, "created collection jaeger-bootstrap-test.spans with schema validation")
+	assert.Contains(t, changes, "created index TagsIndex on jaeger-bootstrap-test.spans")
+	assert.Contains(t, changes, "created index TTLIndex on jaeger-bootstrap-test.dependencies")
+
+	changes, err = jaeger_mongodb.Bootstrap(ctx, db, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, changes)
+
+	// Documents are validated.
+	writer := jaeger_mongodb.NewSpanWriter(db.Collection("spans"), nil, maxBinaryValueSize)
+	err = writer.WriteSpan(ctx, &model.Span{
+		TraceID:       model.NewTraceID(1, 1),
+		SpanID:        model.NewSpanID(1),
+		OperationName: "GET /customer",
+		StartTime:     time.Now(),
+		Process:       &model.Process{ServiceName: "frontend"},
+	})
+	assert.NoError(t, err)
+	_, err = db.Collection("spans").InsertOne(ctx, bson.D{{Key: "traceID", Value: 1}})
+	assert.Error(t, err)
+}
+
+func TestBootstrapApplyTTLIntegration(t *testing.T) {
+	m := connectIT(t)
+	ctx := context.Background()
+	db := m.Database("jaeger-bootstrap-ttl-test")
+	defer func() {
+		db.Drop(ctx)
+		m.Disconnect(ctx)
+	}()
+
+	config := jaeger_mongodb.Configuration{
+		MongoCollection:             "spans",
+		MongoArchiveCollection:      "archive",
+		MongoDependenciesCollection: "dependencies",
+		MongoSpanTTLDuration:        time.Hour,
+		MongoLayout:                 "span",
+	}
+	if _, err := jaeger_mongodb.Bootstrap(ctx, db, config); err != nil {
+		t.Fatal(err)
+	}
+
+	// A changed TTL makes the indexes diverge unless it is applied.
+	config.MongoSpanTTLDuration = 24 * time.Hour
+	_, err := jaeger_mongodb.Bootstrap(ctx, db, config)
+	assert.Error(t, err)
+
+	config.MongoApplyTTL = true
+	changes, err := jaeger_mongodb.Bootstrap(ctx, db, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		"changed retention of index TTLIndex of spans from 1h0m0s to 24h0m0s",
+		"changed retention of index TTLIndex of dependencies from 1h0m0s to 24h0m0s",
+	}, changes)
+}
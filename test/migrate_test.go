@@ -0,0 +1,225 @@
+package jaeger_mongodb_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+
+	jaeger_mongodb "jaeger-mongodb/internal/jaeger-mongodb"
+)
+
+// legacySpan returns a span as written by versions of the plugin before
+// schema versions, which stored every tag value as a string.
+func legacySpan(traceID model.TraceID, spanID model.SpanID) jaeger_mongodb.Span {
+	return jaeger_mongodb.Span{
+		TraceID:       traceID.String(),
+		SpanID:        spanID.String(),
+		OperationName: "GET /customer",
+		StartTime:     time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+		Duration:      1000,
+		Process:       jaeger_mongodb.Process{ServiceName: "frontend"},
+		Tags: []jaeger_mongodb.KeyValue{
+			{Key: "span.kind", Type: jaeger_mongodb.StringType, Value: "server"},
+			{Key: "http.status_code", Type: jaeger_mongodb.Int64Type, Value: "500"},
+		},
+	}
+}
+
+func TestMigrateIntegration(t *testing.T) {
+	m := connectIT(t)
+	ctx := context.Background()
+	db := m.Database("jaeger-migrate-test")
+	defer func() {
+		db.Drop(ctx)
+		m.Disconnect(ctx)
+	}()
+
+	collection := db.Collection("spans")
+	for i := 1; i <= 5; i++ {
+		if _, err := collection.InsertOne(ctx, legacySpan(model.NewTraceID(1, 1), model.NewSpanID(uint64(i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer := jaeger_mongodb.NewSpanWriter(collection, nil, maxBinaryValueSize)
+	err := writer.WriteSpan(ctx, &model.Span{
+		TraceID:       model.NewTraceID(1, 1),
+		SpanID:        model.NewSpanID(6),
+		OperationName: "GET /customer",
+		StartTime:     time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+		Process:       &model.Process{ServiceName: "frontend"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	migrations := db.Collection("migrations")
+	migrator := jaeger_mongodb.NewMigrator(migrations, nil, 2)
+	migrated, err := migrator.Migrate(ctx, collection, jaeger_mongodb.LayoutSpan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(5), migrated)
+
+	var spans []jaeger_mongodb.Span
+	cursor, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cursor.All(ctx, &spans); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 6, len(spans))
+	for _, span := range spans {
+		assert.Equal(t, jaeger_mongodb.SchemaVersion, span.SchemaVersion)
+		if span.SpanID != model.NewSpanID(6).String() {
+			assert.Equal(t, "server", span.SpanKind)
+			assert.Equal(t, int64(500), span.Tags[1].Value)
+		}
+	}
+
+	migration, err := migrator.GetMigration(ctx, "spans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(5), migration.Migrated)
+	assert.Equal(t, jaeger_mongodb.SchemaVersion, migration.Version)
+	assert.NotNil(t, migration.CompletedAt)
+
+	// Running it again changes nothing.
+	migrated, err = migrator.Migrate(ctx, collection, jaeger_mongodb.LayoutSpan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(0), migrated)
+
+	// The spans of a trace document are upgraded in place.
+	traces := db.Collection("traces")
+	_, err = traces.InsertOne(ctx, jaeger_mongodb.TraceDocument{
+		TraceID:   model.NewTraceID(2, 2).String(),
+		StartTime: time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+		EndTime:   time.Date(2021, 7, 1, 1, 1, 2, 0, time.UTC),
+		SpanCount: 1,
+		Spans:     []jaeger_mongodb.Span{legacySpan(model.NewTraceID(2, 2), model.NewSpanID(1))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated, err = migrator.Migrate(ctx, traces, jaeger_mongodb.LayoutTrace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(1), migrated)
+	var doc jaeger_mongodb.TraceDocument
+	if err := traces.FindOne(ctx, bson.D{}).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, jaeger_mongodb.SchemaVersion, doc.Spans[0].SchemaVersion)
+	assert.Equal(t, int64(500), doc.Spans[0].Tags[1].Value)
+
+	// Documents of a newer version are not read.
+	newer := legacySpan(model.NewTraceID(3, 3), model.NewSpanID(1))
+	newer.SchemaVersion = jaeger_mongodb.SchemaVersion + 1
+	if _, err := collection.InsertOne(ctx, newer); err != nil {
+		t.Fatal(err)
+	}
+	reader := jaeger_mongodb.NewSpanReader(jaeger_mongodb.NewMongoReaderStorage(collection), nil, timeoutDuration)
+	_, err = reader.GetTrace(ctx, model.NewTraceID(3, 3))
+	assert.Error(t, err)
+}
+
+func TestMigrateConcurrentWritesIntegration(t *testing.T) {
+	m := connectIT(t)
+	ctx := context.Background()
+	db := m.Database("jaeger-migrate-concurrent-test")
+	defer func() {
+		db.Drop(ctx)
+		m.Disconnect(ctx)
+	}()
+
+	traces := db.Collection("traces")
+	const traceCount, spansPerTrace = 100, 5
+	for i := 1; i <= traceCount; i++ {
+		traceID := model.NewTraceID(1, uint64(i))
+		_, err := traces.InsertOne(ctx, jaeger_mongodb.TraceDocument{
+			TraceID:   traceID.String(),
+			StartTime: time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+			EndTime:   time.Date(2021, 7, 1, 1, 1, 2, 0, time.UTC),
+			SpanCount: 1,
+			Spans:     []jaeger_mongodb.Span{legacySpan(traceID, model.NewSpanID(1))},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Spans are added to the traces while they are migrated, so some trace
+	// documents change between being read and being upgraded.
+	writer := jaeger_mongodb.NewSpanWriter(traces, nil, maxBinaryValueSize).WithLayout(jaeger_mongodb.LayoutTrace)
+	written := make(chan error, 1)
+	go func() {
+		for spanID := 2; spanID <= spansPerTrace; spanID++ {
+			for i := 1; i <= traceCount; i++ {
+				err := writer.WriteSpan(ctx, &model.Span{
+					TraceID:       model.NewTraceID(1, uint64(i)),
+					SpanID:        model.NewSpanID(uint64(spanID)),
+					OperationName: "GET /customer",
+					StartTime:     time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+					Process:       &model.Process{ServiceName: "frontend"},
+				})
+				if err != nil {
+					written <- err
+					return
+				}
+			}
+		}
+		written <- nil
+	}()
+
+	migrator := jaeger_mongodb.NewMigrator(db.Collection("migrations"), nil, 10)
+	migrated, err := migrator.Migrate(ctx, traces, jaeger_mongodb.LayoutTrace)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if err != nil {
+		// A pass raced with the writes to every remaining document; the
+		// migration is incomplete and resumes once run again.
+		migration, err := migrator.GetMigration(ctx, "traces")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Nil(t, migration.CompletedAt)
+		n, err := migrator.Migrate(ctx, traces, jaeger_mongodb.LayoutTrace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		migrated += n
+	}
+	assert.Equal(t, int64(traceCount), migrated)
+
+	var docs []jaeger_mongodb.TraceDocument
+	cursor, err := traces.Find(ctx, bson.D{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cursor.All(ctx, &docs); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, traceCount, len(docs))
+	for _, doc := range docs {
+		assert.Equal(t, int64(spansPerTrace), doc.SpanCount)
+		assert.Equal(t, spansPerTrace, len(doc.Spans))
+		for _, span := range doc.Spans {
+			assert.Equal(t, jaeger_mongodb.SchemaVersion, span.SchemaVersion, doc.TraceID)
+		}
+	}
+
+	migration, err := migrator.GetMigration(ctx, "traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotNil(t, migration.CompletedAt)
+}
@@ -0,0 +1,61 @@
+package jaeger_mongodb_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+
+	jaeger_mongodb "jaeger-mongodb/internal/jaeger-mongodb"
+)
+
+func TestStorePluginIntegration(t *testing.T) {
+	m := connectIT(t)
+	ctx := context.Background()
+	db := m.Database("jaeger-plugin-test")
+	defer func() {
+		db.Drop(ctx)
+		m.Disconnect(ctx)
+	}()
+
+	collection := db.Collection("spans")
+	archive := db.Collection("archive")
+	writer, err := jaeger_mongodb.NewBufferedSpanWriter(
+		jaeger_mongodb.NewSpanWriter(collection, nil, maxBinaryValueSize), 10, 10, time.Hour, timeoutDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := jaeger_mongodb.NewStorePlugin(
+		jaeger_mongodb.NewSpanReader(jaeger_mongodb.NewMongoReaderStorage(collection), nil, timeoutDuration),
+		writer,
+		jaeger_mongodb.NewSpanReader(jaeger_mongodb.NewMongoReaderStorage(archive), nil, timeoutDuration),
+		jaeger_mongodb.NewArchiveSpanWriter(archive, nil, maxBinaryValueSize),
+	)
+
+	// The collector streams spans to the buffered writer.
+	assert.Same(t, writer, plugin.StreamingSpanWriter())
+	span := &model.Span{
+		TraceID:       model.NewTraceID(1, 1),
+		SpanID:        model.NewSpanID(1),
+		OperationName: "GET /",
+		StartTime:     time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+		Duration:      time.Second,
+		Process:       &model.Process{ServiceName: "frontend"},
+	}
+	if err := plugin.StreamingSpanWriter().WriteSpan(ctx, span); err != nil {
+		t.Fatal(err)
+	}
+	// Closing the plugin flushes the buffered span.
+	if err := plugin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	trace, err := plugin.SpanReader().GetTrace(ctx, span.TraceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(trace.GetSpans()))
+	assert.Equal(t, "GET /", trace.GetSpans()[0].OperationName)
+}
@@ -2,6 +2,7 @@ package jaeger_mongodb_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
@@ -11,10 +12,12 @@ import (
 	"time"
 
 	"github.com/golang/mock/gomock"
+	"github.com/hashicorp/go-hclog"
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/stretchr/testify/assert"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/writeconcern"
@@ -42,6 +45,8 @@ var spanTagsFailure []model.KeyValue = []model.KeyValue{
 
 var timeoutDuration, _ = time.ParseDuration("30s")
 
+const maxBinaryValueSize = 4096
+
 // Helper function to verify depedency pattern is valid.
 func isValidDepedencyPattern(pattern string) bool {
 	switch pattern {
@@ -92,7 +97,7 @@ func generateTraces(ctx context.Context, writer *jaeger_mongodb.SpanWriter, numT
 			},
 			Logs: []model.Log{
 				{
-					Timestamp: time.Now(),
+					Timestamp: time.Date(2021, 7, 1, 1, 1, 1, 1, time.UTC),
 					Fields:    spanTagsSuccess,
 				},
 			},
@@ -157,7 +162,7 @@ func TestReaderIntegration(t *testing.T) {
 				collectionName := createNewCollectionName(uniqueCollectionName)
 				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
 				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
-				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
 				// Generate single dependency traces
 				generateTraces(ctx, writer, 100, "single", false)
 				dls, err := reader.GetDependencies(ctx, endTs, lookback)
@@ -189,7 +194,7 @@ func TestReaderIntegration(t *testing.T) {
 				collectionName := createNewCollectionName(uniqueCollectionName)
 				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
 				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
-				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
 				// Generate traces with circular dependencies
 				generateTraces(ctx, writer, 50, "circular", false)
 				dls, err := reader.GetDependencies(ctx, endTs, lookback)
@@ -237,7 +242,7 @@ func TestReaderIntegration(t *testing.T) {
 				collectionName := createNewCollectionName(uniqueCollectionName)
 				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
 				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
-				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
 				generateTraces(ctx, writer, 3, "single", false)
 				dls, err := reader.GetDependencies(ctx, endTs, lookback)
 				if err != nil {
@@ -269,7 +274,7 @@ func TestReaderIntegration(t *testing.T) {
 				collectionName := createNewCollectionName(uniqueCollectionName)
 				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
 				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
-				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
 				generateTraces(ctx, writer, 100, "circular", true)
 				dls, err := reader.GetDependencies(ctx, endTs, lookback)
 				if err != nil {
@@ -279,6 +284,43 @@ func TestReaderIntegration(t *testing.T) {
 				assert.Equal(t, 0, len(dls), "number of dependency links should be 0")
 			},
 		},
+		{
+			name:     "Test GetDependencies -- rolled up links",
+			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
+			lookback: fourteenDays,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				collection := m.Database("jaeger-tracing-test").Collection(collectionName)
+				dependencies := m.Database("jaeger-tracing-test").Collection(createNewCollectionName(uniqueCollectionName))
+				reader := jaeger_mongodb.NewSpanReader(jaeger_mongodb.NewMongoReaderStorage(collection), nil, timeoutDuration).
+					WithDependenciesStorage(jaeger_mongodb.NewMongoReaderStorage(dependencies))
+				writer := jaeger_mongodb.NewSpanWriter(collection, nil, maxBinaryValueSize)
+				generateTraces(ctx, writer, 100, "single", false)
+				rollup := jaeger_mongodb.NewDependenciesRollup(collection, dependencies, nil, time.Hour, 0, lookback, timeoutDuration)
+				if err := rollup.RollupPending(ctx, endTs); err != nil {
+					t.Error(err)
+				}
+				dls, err := reader.GetDependencies(ctx, endTs, lookback)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 99, len(dls), "number of dependency links should be 99")
+				for _, dl := range dls {
+					assert.Equal(t, uint64(1), dl.CallCount)
+				}
+				// Rolling up again must not count the links twice.
+				if err := rollup.Rollup(ctx, time.Date(2021, 7, 1, 1, 0, 0, 0, time.UTC), time.Date(2021, 7, 1, 2, 0, 0, 0, time.UTC)); err != nil {
+					t.Error(err)
+				}
+				dls, err = reader.GetDependencies(ctx, endTs, lookback)
+				if err != nil {
+					t.Error(err)
+				}
+				for _, dl := range dls {
+					assert.Equal(t, uint64(1), dl.CallCount)
+				}
+			},
+		},
 		{
 			name:     "Test GetServices",
 			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
@@ -287,7 +329,7 @@ func TestReaderIntegration(t *testing.T) {
 				collectionName := createNewCollectionName(uniqueCollectionName)
 				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
 				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
-				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
 				generateTraces(ctx, writer, 50, "circular", false)
 				ops, err := reader.GetServices(ctx)
 				if err != nil {
@@ -316,7 +358,7 @@ func TestReaderIntegration(t *testing.T) {
 				collectionName := createNewCollectionName(uniqueCollectionName)
 				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
 				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
-				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
 				generateTraces(ctx, writer, 50, "circular", false)
 				ops, err := reader.GetOperations(ctx, spanstore.OperationQueryParameters{})
 				if err != nil {
@@ -330,6 +372,125 @@ func TestReaderIntegration(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:     "Test GetServices and GetOperations -- catalog",
+			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
+			lookback: fourteenDays,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				collection := m.Database("jaeger-tracing-test").Collection(collectionName)
+				catalog := m.Database("jaeger-tracing-test").Collection(createNewCollectionName(uniqueCollectionName))
+				reader := jaeger_mongodb.NewSpanReader(jaeger_mongodb.NewMongoReaderStorage(collection), nil, timeoutDuration).
+					WithCatalogStorage(jaeger_mongodb.NewMongoReaderStorage(catalog))
+				writer := jaeger_mongodb.NewSpanWriter(collection, nil, maxBinaryValueSize).WithCatalog(catalog)
+				generateTraces(ctx, writer, 50, "circular", false)
+				services, err := reader.GetServices(ctx)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 50, len(services), "number of services should be 50")
+				ops, err := reader.GetOperations(ctx, spanstore.OperationQueryParameters{})
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 4, len(ops), "number of operations should be 4")
+				for _, op := range ops {
+					assert.Contains(t, [4]string{"grpc", "http", "spark", "redis"}, op.Name)
+				}
+				ops, err = reader.GetOperations(ctx, spanstore.OperationQueryParameters{ServiceName: "Service 1"})
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, []spanstore.Operation{{Name: "http", SpanKind: ""}}, ops)
+			},
+		},
+		{
+			name:     "Test GetOperations -- span kinds",
+			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
+			lookback: fourteenDays,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				collection := m.Database("jaeger-tracing-test").Collection(collectionName)
+				catalog := m.Database("jaeger-tracing-test").Collection(createNewCollectionName(uniqueCollectionName))
+				writer := jaeger_mongodb.NewSpanWriter(collection, nil, maxBinaryValueSize).WithCatalog(catalog)
+				for i, kind := range []string{"client", "server", "server", ""} {
+					s := model.Span{
+						TraceID:       model.NewTraceID(uint64(i), uint64(i)),
+						SpanID:        model.NewSpanID(uint64(i)),
+						OperationName: "GET /customer",
+						StartTime:     time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+						Duration:      time.Duration(i),
+						Process: &model.Process{
+							ServiceName: "frontend",
+						},
+					}
+					if kind != "" {
+						s.Tags = model.KeyValues{model.String("span.kind", kind)}
+					}
+					if err := writer.WriteSpan(ctx, &s); err != nil {
+						t.Error(err)
+					}
+				}
+				spanReader := jaeger_mongodb.NewSpanReader(jaeger_mongodb.NewMongoReaderStorage(collection), nil, timeoutDuration)
+				catalogReader := jaeger_mongodb.NewSpanReader(jaeger_mongodb.NewMongoReaderStorage(collection), nil, timeoutDuration).
+					WithCatalogStorage(jaeger_mongodb.NewMongoReaderStorage(catalog))
+				for _, reader := range []*jaeger_mongodb.SpanReader{spanReader, catalogReader} {
+					ops, err := reader.GetOperations(ctx, spanstore.OperationQueryParameters{ServiceName: "frontend"})
+					if err != nil {
+						t.Error(err)
+					}
+					assert.ElementsMatch(t, []spanstore.Operation{
+						{Name: "GET /customer", SpanKind: "client"},
+						{Name: "GET /customer", SpanKind: "server"},
+						{Name: "GET /customer", SpanKind: ""},
+					}, ops)
+					ops, err = reader.GetOperations(ctx, spanstore.OperationQueryParameters{ServiceName: "frontend", SpanKind: "server"})
+					if err != nil {
+						t.Error(err)
+					}
+					assert.Equal(t, []spanstore.Operation{{Name: "GET /customer", SpanKind: "server"}}, ops)
+				}
+			},
+		},
+		{
+			name:     "Test GetOperations -- catalog recorded by the buffered writer",
+			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
+			lookback: fourteenDays,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				collection := m.Database("jaeger-tracing-test").Collection(collectionName)
+				catalog := m.Database("jaeger-tracing-test").Collection(createNewCollectionName(uniqueCollectionName))
+				writer, err := jaeger_mongodb.NewBufferedSpanWriter(
+					jaeger_mongodb.NewSpanWriter(collection, nil, maxBinaryValueSize).WithCatalog(catalog),
+					10, 5, time.Hour, timeoutDuration,
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < 12; i++ {
+					s := model.Span{
+						TraceID:       model.NewTraceID(uint64(i), uint64(i)),
+						SpanID:        model.NewSpanID(uint64(i)),
+						OperationName: fmt.Sprintf("GET /customer/%d", i%2),
+						StartTime:     time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+						Process: &model.Process{
+							ServiceName: "frontend",
+						},
+					}
+					if err := writer.WriteSpan(ctx, &s); err != nil {
+						t.Error(err)
+					}
+				}
+				if err := writer.Close(); err != nil {
+					t.Error(err)
+				}
+				n, err := catalog.CountDocuments(ctx, bson.D{})
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, int64(2), n)
+			},
+		},
 		{
 			name:     "Test GetTrace",
 			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
@@ -338,7 +499,7 @@ func TestReaderIntegration(t *testing.T) {
 				collectionName := createNewCollectionName(uniqueCollectionName)
 				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
 				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
-				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
 				generateTraces(ctx, writer, 50, "single", false)
 				for i := 0; i < 50; i++ {
 					trace, err := reader.GetTrace(ctx, model.TraceID{High: uint64(i), Low: uint64(i)})
@@ -349,6 +510,341 @@ func TestReaderIntegration(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:     "Test GetTrace -- logs round trip",
+			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
+			lookback: fourteenDays,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
+				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
+				logs := []model.Log{
+					{
+						Timestamp: time.Date(2021, 7, 1, 1, 1, 1, 1000, time.UTC),
+						Fields: []model.KeyValue{
+							model.String("event", "error"),
+							model.String("message", "connection refused"),
+							model.Bool("retryable", true),
+							model.Int64("attempt", 3),
+							model.Float64("backoff.seconds", 1.5),
+							model.Binary("payload", []byte{0x0a, 0x03, 0x66, 0x6f, 0x6f}),
+						},
+					},
+					{
+						Timestamp: time.Date(2021, 7, 1, 1, 1, 2, 2000, time.UTC),
+						Fields: []model.KeyValue{
+							model.String("event", "retry"),
+						},
+					},
+				}
+				s := model.Span{
+					TraceID:       model.NewTraceID(1, 1),
+					SpanID:        model.NewSpanID(1),
+					OperationName: "http",
+					References:    []model.SpanRef{},
+					StartTime:     time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+					Duration:      time.Second,
+					Tags:          spanTagsSuccess,
+					Process: &model.Process{
+						ServiceName: "Service 1",
+						Tags:        spanTagsSuccess,
+					},
+					Logs: logs,
+				}
+				if err := writer.WriteSpan(ctx, &s); err != nil {
+					t.Error(err)
+				}
+				trace, err := reader.GetTrace(ctx, s.TraceID)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 1, len(trace.GetSpans()))
+				assert.Equal(t, logs, trace.GetSpans()[0].Logs)
+			},
+		},
+		{
+			name:     "Test GetTrace -- warnings, flags and process ID round trip",
+			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
+			lookback: fourteenDays,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
+				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
+				s := model.Span{
+					TraceID:       model.NewTraceID(2, 2),
+					SpanID:        model.NewSpanID(2),
+					OperationName: "grpc",
+					References:    []model.SpanRef{},
+					StartTime:     time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+					Duration:      time.Second,
+					Flags:         model.SampledFlag | model.DebugFlag,
+					Tags:          spanTagsSuccess,
+					Logs:          []model.Log{},
+					ProcessID:     "p1",
+					Process: &model.Process{
+						ServiceName: "Service 2",
+						Tags:        spanTagsSuccess,
+					},
+					Warnings: []string{"clock skew adjustment disabled; not applying calculated delta of -1.5s"},
+				}
+				if err := writer.WriteSpan(ctx, &s); err != nil {
+					t.Error(err)
+				}
+				trace, err := reader.GetTrace(ctx, s.TraceID)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 1, len(trace.GetSpans()))
+				assert.Equal(t, &s, trace.GetSpans()[0])
+			},
+		},
+		{
+			name:     "Test GetTrace -- binary tags are truncated",
+			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
+			lookback: fourteenDays,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
+				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, 4)
+				s := model.Span{
+					TraceID:       model.NewTraceID(3, 3),
+					SpanID:        model.NewSpanID(3),
+					OperationName: "grpc",
+					StartTime:     time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+					Duration:      time.Second,
+					Tags: []model.KeyValue{
+						model.Binary("hash", []byte{0xde, 0xad}),
+						model.Binary("payload", []byte{0xde, 0xad, 0xbe, 0xef, 0x00, 0x01}),
+					},
+					Process: &model.Process{
+						ServiceName: "Service 3",
+					},
+				}
+				if err := writer.WriteSpan(ctx, &s); err != nil {
+					t.Error(err)
+				}
+				trace, err := reader.GetTrace(ctx, s.TraceID)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 1, len(trace.GetSpans()))
+				span := trace.GetSpans()[0]
+				assert.Equal(t, model.KeyValues{
+					model.Binary("hash", []byte{0xde, 0xad}),
+					model.Binary("payload", []byte{0xde, 0xad, 0xbe, 0xef}),
+				}, span.Tags)
+				assert.Equal(t, 1, len(span.Warnings))
+				assert.Empty(t, s.Warnings, "the written span must not be modified")
+			},
+		},
+		{
+			name:     "Test GetTrace -- native and legacy tag values",
+			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
+			lookback: fourteenDays,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				collection := m.Database("jaeger-tracing-test").Collection(collectionName)
+				readerStorage := jaeger_mongodb.NewMongoReaderStorage(collection)
+				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
+				writer := jaeger_mongodb.NewSpanWriter(collection, nil, maxBinaryValueSize)
+				tags := model.KeyValues{
+					model.String("http.method", "GET"),
+					model.Bool("error", true),
+					model.Int64("http.status_code", 500),
+					model.Float64("sampler.param", 0.123456789012345),
+				}
+				s := model.Span{
+					TraceID:       model.NewTraceID(4, 4),
+					SpanID:        model.NewSpanID(4),
+					OperationName: "http",
+					StartTime:     time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+					Duration:      time.Second,
+					Tags:          tags,
+					Process: &model.Process{
+						ServiceName: "Service 4",
+					},
+				}
+				if err := writer.WriteSpan(ctx, &s); err != nil {
+					t.Error(err)
+				}
+				// Spans written by older versions of the plugin store every value as a string.
+				legacy := jaeger_mongodb.Span{
+					TraceID:       model.NewTraceID(4, 4).String(),
+					SpanID:        model.NewSpanID(5).String(),
+					OperationName: "http",
+					StartTime:     time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+					Duration:      1000,
+					Process:       jaeger_mongodb.Process{ServiceName: "Service 4"},
+					Tags: []jaeger_mongodb.KeyValue{
+						{Key: "http.method", Type: jaeger_mongodb.StringType, Value: "GET"},
+						{Key: "error", Type: jaeger_mongodb.BoolType, Value: "true"},
+						{Key: "http.status_code", Type: jaeger_mongodb.Int64Type, Value: "500"},
+						{Key: "sampler.param", Type: jaeger_mongodb.Float64Type, Value: "0.25"},
+					},
+				}
+				if _, err := collection.InsertOne(ctx, legacy); err != nil {
+					t.Error(err)
+				}
+				trace, err := reader.GetTrace(ctx, s.TraceID)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 2, len(trace.GetSpans()))
+				for _, span := range trace.GetSpans() {
+					if span.SpanID == s.SpanID {
+						assert.Equal(t, tags, span.Tags)
+					} else {
+						assert.Equal(t, model.KeyValues{
+							model.String("http.method", "GET"),
+							model.Bool("error", true),
+							model.Int64("http.status_code", 500),
+							model.Float64("sampler.param", 0.25),
+						}, span.Tags)
+					}
+				}
+				traces, err := reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
+					StartTimeMin: time.Date(1997, 04, 30, 05, 1, 1, 1, time.UTC),
+					StartTimeMax: time.Now(),
+					NumTraces:    10,
+					Tags: map[string]string{
+						"http.status_code": "500",
+						"error":            "true",
+					},
+				})
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 1, len(traces))
+				assert.Equal(t, 2, len(traces[0].GetSpans()))
+
+				mismatch := legacySpan(model.NewTraceID(5, 5), model.NewSpanID(1))
+				mismatch.Tags = []jaeger_mongodb.KeyValue{{Key: "http.method", Type: jaeger_mongodb.StringType, Value: int64(42)}}
+				if _, err := collection.InsertOne(ctx, mismatch); err != nil {
+					t.Error(err)
+				}
+				_, err = reader.GetTrace(ctx, model.NewTraceID(5, 5))
+				assert.ErrorContains(t, err, `invalid value of tag "http.method": expected string, found int64`)
+			},
+		},
+		{
+			name:     "Test BufferedSpanWriter -- flush on close",
+			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
+			lookback: fourteenDays,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				collection := m.Database("jaeger-tracing-test").Collection(collectionName)
+				readerStorage := jaeger_mongodb.NewMongoReaderStorage(collection)
+				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
+				writer, err := jaeger_mongodb.NewBufferedSpanWriter(
+					jaeger_mongodb.NewSpanWriter(collection, nil, maxBinaryValueSize),
+					10, 7, time.Hour, timeoutDuration,
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < 50; i++ {
+					s := model.Span{
+						TraceID:       model.NewTraceID(uint64(i), uint64(i)),
+						SpanID:        model.NewSpanID(uint64(i)),
+						OperationName: "http",
+						StartTime:     time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+						Duration:      time.Second,
+						Process: &model.Process{
+							ServiceName: fmt.Sprintf("Service %d", i),
+						},
+					}
+					if err := writer.WriteSpan(ctx, &s); err != nil {
+						t.Error(err)
+					}
+				}
+				if err := writer.Close(); err != nil {
+					t.Error(err)
+				}
+				err = writer.WriteSpan(ctx, &model.Span{Process: &model.Process{}})
+				assert.Equal(t, jaeger_mongodb.ErrWriterClosed, err)
+				traces, err := reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
+					StartTimeMin: time.Date(1997, 04, 30, 05, 1, 1, 1, time.UTC),
+					StartTimeMax: time.Now(),
+					NumTraces:    1500,
+				})
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 50, len(traces))
+			},
+		},
+		{
+			name:     "Test ArchiveSpanWriter -- archiving twice does not duplicate",
+			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
+			lookback: fourteenDays,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				collection := m.Database("jaeger-tracing-test").Collection(collectionName)
+				readerStorage := jaeger_mongodb.NewMongoReaderStorage(collection)
+				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
+				writer := jaeger_mongodb.NewArchiveSpanWriter(collection, nil, maxBinaryValueSize)
+				generateTraces(ctx, writer, 10, "single", false)
+				generateTraces(ctx, writer, 10, "single", false)
+				for i := 0; i < 10; i++ {
+					trace, err := reader.GetTrace(ctx, model.TraceID{High: uint64(i), Low: uint64(i)})
+					if err != nil {
+						t.Error(err)
+					}
+					assert.Equal(t, 1, len(trace.GetSpans()))
+				}
+			},
+		},
+		{
+			name:     "Test SpanWriter -- rewriting spans is idempotent",
+			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
+			lookback: fourteenDays,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				collection := m.Database("jaeger-tracing-test").Collection(collectionName)
+				readerStorage := jaeger_mongodb.NewMongoReaderStorage(collection)
+				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
+				writer := jaeger_mongodb.NewSpanWriter(collection, nil, maxBinaryValueSize)
+				generateTraces(ctx, writer, 10, "single", false)
+				generateTraces(ctx, writer, 10, "single", false)
+				count, err := collection.CountDocuments(ctx, bson.D{})
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, int64(10), count)
+				dls, err := reader.GetDependencies(ctx, endTs, lookback)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 9, len(dls))
+				for _, dl := range dls {
+					assert.Equal(t, uint64(1), dl.CallCount)
+				}
+
+				// Changing the truncation of binary values does not store a
+				// replayed span again.
+				binary := model.Span{
+					TraceID:       model.NewTraceID(7, 7),
+					SpanID:        model.NewSpanID(7),
+					OperationName: "upload",
+					StartTime:     time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC),
+					Tags:          model.KeyValues{model.Binary("payload", make([]byte, 100))},
+					Process:       &model.Process{ServiceName: "Service 7"},
+				}
+				for _, size := range []int{10, 20} {
+					if err := jaeger_mongodb.NewSpanWriter(collection, nil, size).WriteSpan(ctx, &binary); err != nil {
+						t.Error(err)
+					}
+				}
+				count, err = collection.CountDocuments(ctx, bson.D{})
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, int64(11), count)
+			},
+		},
 		{
 			name:     "Test Find Traces",
 			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
@@ -357,7 +853,7 @@ func TestReaderIntegration(t *testing.T) {
 				collectionName := createNewCollectionName(uniqueCollectionName)
 				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
 				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
-				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
 				generateTraces(ctx, writer, 50, "single", false)
 				traces, err := reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
 					StartTimeMin: time.Date(1997, 04, 30, 05, 1, 1, 1, time.UTC),
@@ -375,6 +871,57 @@ func TestReaderIntegration(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:     "Test Find Traces -- newest traces first",
+			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
+			lookback: fourteenDays,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
+				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
+				start := time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC)
+				for i := 0; i < 50; i++ {
+					// Two spans per trace, the trace's latest span starting i minutes after start.
+					for j := 0; j < 2; j++ {
+						s := model.Span{
+							TraceID:       model.NewTraceID(uint64(i), uint64(i)),
+							SpanID:        model.NewSpanID(uint64(2*i + j)),
+							OperationName: "http",
+							StartTime:     start.Add(time.Duration(i)*time.Minute - time.Duration(j)*time.Second),
+							Duration:      time.Second,
+							Process: &model.Process{
+								ServiceName: "Service 1",
+							},
+						}
+						if err := writer.WriteSpan(ctx, &s); err != nil {
+							t.Error(err)
+						}
+					}
+				}
+				query := &spanstore.TraceQueryParameters{
+					StartTimeMin: start.Add(-time.Hour),
+					StartTimeMax: start.Add(time.Hour * 2),
+					NumTraces:    10,
+				}
+				traces, err := reader.FindTraces(ctx, query)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 10, len(traces))
+				for i, trace := range traces {
+					assert.Equal(t, model.NewTraceID(uint64(49-i), uint64(49-i)), trace.GetSpans()[0].TraceID)
+					assert.Equal(t, 2, len(trace.GetSpans()))
+				}
+				ids, err := reader.FindTraceIDs(ctx, query)
+				if err != nil {
+					t.Error(err)
+				}
+				for i, id := range ids {
+					assert.Equal(t, model.NewTraceID(uint64(49-i), uint64(49-i)), id)
+				}
+			},
+		},
 		{
 			name:     "Test Find Traces -- Tag Filtering",
 			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
@@ -383,7 +930,7 @@ func TestReaderIntegration(t *testing.T) {
 				collectionName := createNewCollectionName(uniqueCollectionName)
 				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
 				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
-				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
 				generateTraces(ctx, writer, 50, "circular", false)
 				traces200, err := reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
 					StartTimeMin: time.Date(1997, 04, 30, 05, 1, 1, 1, time.UTC),
@@ -413,6 +960,291 @@ func TestReaderIntegration(t *testing.T) {
 				assert.Equal(t, 5, len(traces404))
 			},
 		},
+		{
+			name:     "Test Find Traces -- tags on different spans",
+			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
+			lookback: fourteenDays,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
+				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
+				start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+				// Trace 1 has both tags on different spans, trace 2 only one of them.
+				spans := []model.Span{
+					{TraceID: model.NewTraceID(1, 1), SpanID: model.NewSpanID(1), OperationName: "GET /customer", Tags: []model.KeyValue{model.Bool("error", true)}},
+					{TraceID: model.NewTraceID(1, 1), SpanID: model.NewSpanID(2), OperationName: "SQL SELECT", Tags: []model.KeyValue{model.String("customer.id", "123")}},
+					{TraceID: model.NewTraceID(2, 2), SpanID: model.NewSpanID(3), OperationName: "GET /customer", Tags: []model.KeyValue{model.Bool("error", true)}},
+					{TraceID: model.NewTraceID(2, 2), SpanID: model.NewSpanID(4), OperationName: "SQL SELECT", Tags: []model.KeyValue{model.String("customer.id", "456")}},
+				}
+				for i := range spans {
+					spans[i].StartTime = start
+					spans[i].Duration = time.Second
+					spans[i].Process = &model.Process{ServiceName: "frontend"}
+					if err := writer.WriteSpan(ctx, &spans[i]); err != nil {
+						t.Error(err)
+					}
+				}
+				query := &spanstore.TraceQueryParameters{
+					ServiceName:  "frontend",
+					StartTimeMin: start.Add(-time.Hour),
+					StartTimeMax: start.Add(time.Hour),
+					Tags:         map[string]string{"error": "true", "customer.id": "123"},
+				}
+				ids, err := reader.FindTraceIDs(ctx, query)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Empty(t, ids)
+
+				reader.WithTagMatch(jaeger_mongodb.TagMatchTrace)
+				ids, err = reader.FindTraceIDs(ctx, query)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, []model.TraceID{model.NewTraceID(1, 1)}, ids)
+
+				// The mode can also be selected per query.
+				reader.WithTagMatch(jaeger_mongodb.TagMatchSpan)
+				query.Tags[jaeger_mongodb.TagMatchTag] = "trace"
+				traces, err := reader.FindTraces(ctx, query)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 1, len(traces))
+				assert.Equal(t, 2, len(traces[0].GetSpans()))
+			},
+		},
+		{
+			name:     "Test Find Traces -- process tags and log fields",
+			endTs:    time.Date(2021, 7, 2, 1, 1, 1, 1, time.UTC),
+			lookback: fourteenDays,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
+				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
+				start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+				s := model.Span{
+					TraceID:       model.NewTraceID(1, 1),
+					SpanID:        model.NewSpanID(1),
+					OperationName: "GET /customer",
+					StartTime:     start,
+					Duration:      time.Second,
+					Tags:          []model.KeyValue{model.String("http.method", "GET")},
+					Logs: []model.Log{{
+						Timestamp: start,
+						Fields:    []model.KeyValue{model.String("event", "retry")},
+					}},
+					Process: &model.Process{
+						ServiceName: "frontend",
+						Tags:        []model.KeyValue{model.String("hostname", "host-1")},
+					},
+				}
+				if err := writer.WriteSpan(ctx, &s); err != nil {
+					t.Error(err)
+				}
+				for _, tags := range []map[string]string{
+					{"hostname": "host-1"},
+					{"event": "retry"},
+					{"hostname": "host-1", "event": "retry", "http.method": "GET"},
+				} {
+					ids, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+						ServiceName:  "frontend",
+						StartTimeMin: start.Add(-time.Hour),
+						StartTimeMax: start.Add(time.Hour),
+						Tags:         tags,
+					})
+					if err != nil {
+						t.Error(err)
+					}
+					assert.Equal(t, []model.TraceID{model.NewTraceID(1, 1)}, ids, tags)
+				}
+				ids, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+					ServiceName:  "frontend",
+					StartTimeMin: start.Add(-time.Hour),
+					StartTimeMax: start.Add(time.Hour),
+					Tags:         map[string]string{"hostname": "host-2"},
+				})
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Empty(t, ids)
+			},
+		},
+		{
+			name:     "Test trace layout",
+			endTs:    time.Date(2022, 1, 1, 1, 0, 0, 0, time.UTC),
+			lookback: time.Hour * 2,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				collection := m.Database("jaeger-tracing-test").Collection(collectionName)
+				readerStorage := jaeger_mongodb.NewMongoReaderStorage(collection)
+				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration).
+					WithLayout(jaeger_mongodb.LayoutTrace)
+				writer := jaeger_mongodb.NewSpanWriter(collection, nil, maxBinaryValueSize).
+					WithLayout(jaeger_mongodb.LayoutTrace)
+				start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+				traceID := model.NewTraceID(1, 1)
+				root := model.Span{
+					TraceID:       traceID,
+					SpanID:        model.NewSpanID(1),
+					OperationName: "GET /customer",
+					StartTime:     start,
+					Duration:      time.Second,
+					Tags:          []model.KeyValue{model.String("span.kind", "server")},
+					Process:       &model.Process{ServiceName: "frontend"},
+				}
+				child := model.Span{
+					TraceID:       traceID,
+					SpanID:        model.NewSpanID(2),
+					OperationName: "SQL SELECT",
+					References:    []model.SpanRef{model.NewChildOfRef(traceID, model.NewSpanID(1))},
+					StartTime:     start.Add(time.Millisecond),
+					Duration:      2 * time.Second,
+					Tags:          []model.KeyValue{model.Bool("error", true)},
+					Process:       &model.Process{ServiceName: "mysql"},
+				}
+				// The child is written twice, as by a retried request.
+				for _, s := range []*model.Span{&child, &root, &child} {
+					if err := writer.WriteSpan(ctx, s); err != nil {
+						t.Error(err)
+					}
+				}
+
+				var doc jaeger_mongodb.TraceDocument
+				if err := collection.FindOne(ctx, bson.D{{Key: "_id", Value: traceID.String()}}).Decode(&doc); err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, "frontend", doc.RootService)
+				assert.Equal(t, "GET /customer", doc.RootOperation)
+				assert.True(t, doc.StartTime.Equal(start))
+				assert.True(t, doc.EndTime.Equal(start.Add(2*time.Second+time.Millisecond)))
+				assert.Equal(t, int64(2), doc.SpanCount)
+				assert.True(t, doc.Error)
+
+				trace, err := reader.GetTrace(ctx, traceID)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 2, len(trace.GetSpans()))
+
+				traces, err := reader.FindTraces(ctx, &spanstore.TraceQueryParameters{
+					ServiceName:  "mysql",
+					StartTimeMin: start.Add(-time.Hour),
+					StartTimeMax: start.Add(time.Hour),
+					Tags:         map[string]string{"error": "true"},
+				})
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 1, len(traces))
+
+				services, err := reader.GetServices(ctx)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.ElementsMatch(t, []string{"frontend", "mysql"}, services)
+
+				ops, err := reader.GetOperations(ctx, spanstore.OperationQueryParameters{ServiceName: "frontend"})
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, []spanstore.Operation{{Name: "GET /customer", SpanKind: "server"}}, ops)
+
+				dls, err := reader.GetDependencies(ctx, endTs, lookback)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, []model.DependencyLink{{Parent: "frontend", Child: "mysql", CallCount: 1}}, dls)
+			},
+		},
+		{
+			name:     "Test time-series layout",
+			endTs:    time.Date(2022, 1, 1, 1, 0, 0, 0, time.UTC),
+			lookback: time.Hour * 2,
+			runAssertion: func(endTs time.Time, lookback time.Duration) {
+				collectionName := createNewCollectionName(uniqueCollectionName)
+				db := m.Database("jaeger-tracing-test")
+				created, err := jaeger_mongodb.CreateTimeSeriesCollection(ctx, db, collectionName, fourteenDays*100)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.True(t, created)
+				created, err = jaeger_mongodb.CreateTimeSeriesCollection(ctx, db, collectionName, fourteenDays*100)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.False(t, created)
+
+				collection := db.Collection(collectionName)
+				if _, err := jaeger_mongodb.CreateIndexes(ctx, collection, jaeger_mongodb.TimeSeriesIndexes()); err != nil {
+					t.Error(err)
+				}
+				readerStorage := jaeger_mongodb.NewMongoReaderStorage(collection)
+				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration).
+					WithLayout(jaeger_mongodb.LayoutTimeSeries)
+				writer := jaeger_mongodb.NewSpanWriter(collection, nil, maxBinaryValueSize).
+					WithLayout(jaeger_mongodb.LayoutTimeSeries)
+				start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+				traceID := model.NewTraceID(1, 1)
+				root := model.Span{
+					TraceID:       traceID,
+					SpanID:        model.NewSpanID(1),
+					OperationName: "GET /customer",
+					StartTime:     start,
+					Duration:      time.Second,
+					Process:       &model.Process{ServiceName: "frontend"},
+				}
+				child := model.Span{
+					TraceID:       traceID,
+					SpanID:        model.NewSpanID(2),
+					OperationName: "SQL SELECT",
+					References:    []model.SpanRef{model.NewChildOfRef(traceID, model.NewSpanID(1))},
+					StartTime:     start.Add(time.Millisecond),
+					Duration:      time.Millisecond,
+					Process:       &model.Process{ServiceName: "mysql"},
+				}
+				// The child is written twice, as by a retried request.
+				for _, s := range []*model.Span{&root, &child, &child} {
+					if err := writer.WriteSpan(ctx, s); err != nil {
+						t.Error(err)
+					}
+				}
+
+				trace, err := reader.GetTrace(ctx, traceID)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, 2, len(trace.GetSpans()))
+
+				ids, err := reader.FindTraceIDs(ctx, &spanstore.TraceQueryParameters{
+					ServiceName:   "frontend",
+					OperationName: "GET /customer",
+					StartTimeMin:  start.Add(-time.Hour),
+					StartTimeMax:  start.Add(time.Hour),
+				})
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, []model.TraceID{traceID}, ids)
+
+				// The child written twice is counted once.
+				dls, err := reader.GetDependencies(ctx, endTs, lookback)
+				if err != nil {
+					t.Error(err)
+				}
+				assert.Equal(t, []model.DependencyLink{{Parent: "frontend", Child: "mysql", CallCount: 1}}, dls)
+
+				// A collection that is not a time-series collection is not converted.
+				plainName := createNewCollectionName(uniqueCollectionName)
+				if err := db.CreateCollection(ctx, plainName); err != nil {
+					t.Error(err)
+				}
+				_, err = jaeger_mongodb.CreateTimeSeriesCollection(ctx, db, plainName, fourteenDays)
+				assert.Error(t, err)
+			},
+		},
 	}
 	for _, tc := range testCases {
 		println(tc.name)
@@ -456,28 +1288,223 @@ func TestReaderUnit(t *testing.T) {
 			},
 		},
 		{
-			name: "Test Get Operations",
+			name: "Test Get Operations -- span kind filter",
 			runAssertion: func() {
 				m := mock.NewMockReaderStorage(ctrl)
 				m.
 					EXPECT().
-					Distinct(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Aggregate(gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, pipeline interface{}, opts *options.AggregateOptions) (*mongo.Cursor, error) {
+						match := pipeline.(mongo.Pipeline)[0][0].Value
+						assert.Equal(t, bson.D{
+							{Key: "process.serviceName", Value: "Service 1"},
+							{Key: "spanKind", Value: "server"},
+						}, match)
+						return nil, errors.New("connection reset")
+					})
+				s := jaeger_mongodb.NewSpanReader(m, nil, timeoutDuration)
+				ops, err := s.GetOperations(context.Background(), spanstore.OperationQueryParameters{
+					ServiceName: "Service 1",
+					SpanKind:    "server",
+				})
+				assert.Error(t, err)
+				assert.Nil(t, ops)
+			},
+		},
+		{
+			name: "Test GetOperations -- trace layout",
+			runAssertion: func() {
+				m := mock.NewMockReaderStorage(ctrl)
+				m.
+					EXPECT().
+					Aggregate(gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, pipeline interface{}, opts *options.AggregateOptions) (*mongo.Cursor, error) {
+						// The trace documents are selected by service before
+						// their spans are unwound.
+						stages := pipeline.(mongo.Pipeline)
+						assert.Equal(t, bson.D{{Key: "$match", Value: bson.D{{Key: "spans.process.serviceName", Value: "Service 1"}}}}, stages[0])
+						assert.Equal(t, "$unwind", stages[2][0].Key)
+						return nil, errors.New("connection reset")
+					})
+				s := jaeger_mongodb.NewSpanReader(m, nil, timeoutDuration).WithLayout(jaeger_mongodb.LayoutTrace)
+				_, err := s.GetOperations(context.Background(), spanstore.OperationQueryParameters{ServiceName: "Service 1"})
+				assert.Error(t, err)
+			},
+		},
+		{
+			name: "Test FindTraceIDs -- combined span predicate",
+			runAssertion: func() {
+				start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+				end := start.Add(time.Hour)
+				errorTag := bson.D{
+					{Key: "key", Value: "error"},
+					{Key: "value", Value: bson.D{{Key: "$in", Value: bson.A{"true", true}}}},
+				}
+				m := mock.NewMockReaderStorage(ctrl)
+				m.
+					EXPECT().
+					Aggregate(gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, pipeline interface{}, opts *options.AggregateOptions) (*mongo.Cursor, error) {
+						match := pipeline.(mongo.Pipeline)[0][0].Value
+						assert.Equal(t, bson.D{
+							{Key: "process.serviceName", Value: "Service 1"},
+							{Key: "operationName", Value: "GET /customer"},
+							{Key: "duration", Value: bson.D{
+								{Key: "$gte", Value: int64(1000)},
+								{Key: "$lte", Value: int64(5000)},
+							}},
+							{Key: "startTime", Value: bson.D{
+								{Key: "$gt", Value: start},
+								{Key: "$lt", Value: end},
+							}},
+							{Key: "$and", Value: bson.A{
+								bson.D{{Key: "$or", Value: bson.A{
+									bson.D{{Key: "tags", Value: bson.D{{Key: "$elemMatch", Value: errorTag}}}},
+									bson.D{{Key: "process.tags", Value: bson.D{{Key: "$elemMatch", Value: errorTag}}}},
+									bson.D{{Key: "logs.fields", Value: bson.D{{Key: "$elemMatch", Value: errorTag}}}},
+								}}},
+							}},
+						}, match)
+						return nil, errors.New("connection reset")
+					})
+				s := jaeger_mongodb.NewSpanReader(m, nil, timeoutDuration)
+				ids, err := s.FindTraceIDs(context.Background(), &spanstore.TraceQueryParameters{
+					ServiceName:   "Service 1",
+					OperationName: "GET /customer",
+					Tags:          map[string]string{"error": "true"},
+					StartTimeMin:  start,
+					StartTimeMax:  end,
+					DurationMin:   time.Millisecond,
+					DurationMax:   5 * time.Millisecond,
+				})
+				assert.Error(t, err)
+				assert.Nil(t, ids)
+			},
+		},
+		{
+			name: "Test FindTraceIDs -- invalid tag match mode",
+			runAssertion: func() {
+				m := mock.NewMockReaderStorage(ctrl)
+				s := jaeger_mongodb.NewSpanReader(m, nil, timeoutDuration)
+				ids, err := s.FindTraceIDs(context.Background(), &spanstore.TraceQueryParameters{
+					Tags: map[string]string{jaeger_mongodb.TagMatchTag: "process"},
+				})
+				assert.Error(t, err)
+				assert.Nil(t, ids)
+			},
+		},
+		{
+			name: "Test GetServices -- trace layout",
+			runAssertion: func() {
+				m := mock.NewMockReaderStorage(ctrl)
+				m.
+					EXPECT().
+					Distinct(gomock.Any(), "spans.process.serviceName", gomock.Any(), gomock.Any()).
+					Return([]interface{}{"Service 1"}, nil)
+				s := jaeger_mongodb.NewSpanReader(m, nil, timeoutDuration).WithLayout(jaeger_mongodb.LayoutTrace)
+				svcs, err := s.GetServices(context.Background())
+				assert.NoError(t, err)
+				assert.Equal(t, []string{"Service 1"}, svcs)
+			},
+		},
+		{
+			name: "Test GetServices -- catalog",
+			runAssertion: func() {
+				spans := mock.NewMockReaderStorage(ctrl)
+				catalog := mock.NewMockReaderStorage(ctrl)
+				catalog.
+					EXPECT().
+					Distinct(gomock.Any(), "serviceName", gomock.Any(), gomock.Any()).
 					Return(
 						[]interface{}{
-							"Operation 1", "Operation 2",
+							"Service 1", "Service 2",
 						},
 						nil,
 					)
-				s := jaeger_mongodb.NewSpanReader(m, nil, timeoutDuration)
-				ops, err := s.GetOperations(context.Background(), spanstore.OperationQueryParameters{})
+				s := jaeger_mongodb.NewSpanReader(spans, nil, timeoutDuration).WithCatalogStorage(catalog)
+				svcs, err := s.GetServices(context.Background())
 				if err != nil {
 					t.Error(err)
 				}
-				for _, op := range ops {
-					fmt.Println(op)
-					assert.Equal(t, "TODO", op.SpanKind)
-					assert.Contains(t, [2]string{"Operation 1", "Operation 2"}, op.Name)
+				assert.Equal(t, []string{"Service 1", "Service 2"}, svcs)
+			},
+		},
+		{
+			name: "Test GetDependencies -- query errors are returned",
+			runAssertion: func() {
+				m := mock.NewMockReaderStorage(ctrl)
+				m.EXPECT().Name().Return("spans")
+				m.
+					EXPECT().
+					Aggregate(gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(nil, errors.New("connection reset"))
+				s := jaeger_mongodb.NewSpanReader(m, nil, timeoutDuration)
+				dls, err := s.GetDependencies(context.Background(), time.Now(), time.Hour)
+				assert.Error(t, err)
+				assert.Nil(t, dls)
+			},
+		},
+		{
+			name: "Test GetServices -- server timeout",
+			runAssertion: func() {
+				m := mock.NewMockReaderStorage(ctrl)
+				m.
+					EXPECT().
+					Distinct(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(nil, mongo.CommandError{Code: 50, Name: "MaxTimeMSExpired", Message: "operation exceeded time limit"})
+				s := jaeger_mongodb.NewSpanReader(m, nil, timeoutDuration)
+				_, err := s.GetServices(context.Background())
+				var timeoutErr *jaeger_mongodb.TimeoutError
+				assert.True(t, errors.As(err, &timeoutErr))
+			},
+		},
+		{
+			name: "Test FindTraces -- context deadline",
+			runAssertion: func() {
+				m := mock.NewMockReaderStorage(ctrl)
+				m.
+					EXPECT().
+					Aggregate(gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, pipeline interface{}, opts *options.AggregateOptions) (*mongo.Cursor, error) {
+						assert.Equal(t, timeoutDuration, *opts.MaxTime)
+						return nil, context.DeadlineExceeded
+					})
+				s := jaeger_mongodb.NewSpanReader(m, hclog.NewNullLogger(), timeoutDuration)
+				_, err := s.FindTraces(context.Background(), &spanstore.TraceQueryParameters{NumTraces: 20})
+				var timeoutErr *jaeger_mongodb.TimeoutError
+				assert.True(t, errors.As(err, &timeoutErr))
+			},
+		},
+		{
+			name: "Test storage errors are returned without crashing the plugin",
+			runAssertion: func() {
+				storageErr := errors.New("connection reset")
+				m := mock.NewMockReaderStorage(ctrl)
+				m.EXPECT().Name().Return("spans").AnyTimes()
+				m.EXPECT().Find(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, storageErr).AnyTimes()
+				m.EXPECT().Aggregate(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, storageErr).AnyTimes()
+				m.EXPECT().Distinct(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil, storageErr).AnyTimes()
+				// A nil logger must not crash the reader either.
+				s := jaeger_mongodb.NewSpanReader(m, nil, timeoutDuration)
+				ctx := context.Background()
+				query := &spanstore.TraceQueryParameters{
+					ServiceName: "Service 1",
+					Tags:        map[string]string{"error": "true"},
+					NumTraces:   20,
 				}
+
+				_, err := s.GetTrace(ctx, model.NewTraceID(1, 1))
+				assert.ErrorIs(t, err, storageErr)
+				_, err = s.FindTraces(ctx, query)
+				assert.ErrorIs(t, err, storageErr)
+				_, err = s.FindTraceIDs(ctx, query)
+				assert.ErrorIs(t, err, storageErr)
+				_, err = s.GetServices(ctx)
+				assert.ErrorIs(t, err, storageErr)
+				_, err = s.GetOperations(ctx, spanstore.OperationQueryParameters{ServiceName: "Service 1"})
+				assert.ErrorIs(t, err, storageErr)
+				_, err = s.GetDependencies(ctx, time.Now(), time.Hour)
+				assert.ErrorIs(t, err, storageErr)
 			},
 		},
 		// TODO: Add more unit tests.
@@ -514,7 +1541,7 @@ func BenchmarkTagFiltering(b *testing.B) {
 			},
 			runAssertion: func(tags_in map[string]string) {
 				collectionName := createNewCollectionName(uniqueCollectionName)
-				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil)
+				writer := jaeger_mongodb.NewSpanWriter(m.Database("jaeger-tracing-test").Collection(collectionName), nil, maxBinaryValueSize)
 				readerStorage := jaeger_mongodb.NewMongoReaderStorage(m.Database("jaeger-tracing-test").Collection(collectionName))
 				reader := jaeger_mongodb.NewSpanReader(readerStorage, nil, timeoutDuration)
 				generateTraces(ctx, writer, 100, "circular", false)
@@ -536,3 +1563,23 @@ func BenchmarkTagFiltering(b *testing.B) {
 	// Clean up Database
 	m.Database("jaeger-tracing-test").Drop(ctx)
 }
+
+func TestBufferedSpanWriterUnit(t *testing.T) {
+	spanWriter := jaeger_mongodb.NewSpanWriter(nil, nil, maxBinaryValueSize)
+	for _, tc := range []struct {
+		name          string
+		queueSize     int
+		batchSize     int
+		flushInterval time.Duration
+	}{
+		{name: "no queue", queueSize: 0, batchSize: 10, flushInterval: time.Second},
+		{name: "no batch", queueSize: 10, batchSize: 0, flushInterval: time.Second},
+		{name: "no flush interval", queueSize: 10, batchSize: 10, flushInterval: 0},
+		{name: "negative flush interval", queueSize: 10, batchSize: 10, flushInterval: -time.Second},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := jaeger_mongodb.NewBufferedSpanWriter(spanWriter, tc.queueSize, tc.batchSize, tc.flushInterval, timeoutDuration)
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package jaeger_mongodb_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+
+	jaeger_mongodb "jaeger-mongodb/internal/jaeger-mongodb"
+)
+
+func TestRetention(t *testing.T) {
+	retention, err := jaeger_mongodb.NewRetention(14*24*time.Hour, map[string]string{
+		"payments":    "720h",
+		"health-*":    "24h",
+		"health-db-*": "48h",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, retention.PerService())
+	assert.Equal(t, 720*time.Hour, retention.TTL("payments"))
+	assert.Equal(t, 720*time.Hour, retention.TTL("Payments"))
+	assert.Equal(t, 24*time.Hour, retention.TTL("health-check"))
+	assert.Equal(t, 48*time.Hour, retention.TTL("health-db-primary"), "the longest glob wins")
+	assert.Equal(t, 14*24*time.Hour, retention.TTL("frontend"))
+	assert.Equal(t, 720*time.Hour, retention.Max())
+
+	retention, err = jaeger_mongodb.NewRetention(time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, retention.PerService())
+	assert.Equal(t, time.Hour, retention.Max())
+
+	_, err = jaeger_mongodb.NewRetention(time.Hour, map[string]string{"payments": "a month"})
+	assert.Error(t, err)
+	_, err = jaeger_mongodb.NewRetention(time.Hour, map[string]string{"health-[": "1h"})
+	assert.Error(t, err)
+}
+
+func TestRetentionIntegration(t *testing.T) {
+	m := connectIT(t)
+	ctx := context.Background()
+	db := m.Database("jaeger-retention-test")
+	defer func() {
+		db.Drop(ctx)
+		m.Disconnect(ctx)
+	}()
+
+	config := jaeger_mongodb.Configuration{
+		MongoCollection:             "spans",
+		MongoArchiveCollection:      "archive",
+		MongoDependenciesCollection: "dependencies",
+		MongoSpanTTLDuration:        time.Hour,
+		MongoServiceTTL:             map[string]string{"payments": "720h"},
+		MongoLayout:                 "span",
+	}
+	changes, err := jaeger_mongodb.Bootstrap(ctx, db, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, changes, "created index ExpireAtIndex on jaeger-retention-test.spans")
+	// Dependency links are kept as long as the spans of the longest kept service.
+	diff, err := jaeger_mongodb.CompareIndexes(ctx, db.Collection("dependencies"), jaeger_mongodb.DependenciesIndexes(720*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, diff.Diverged(), diff.String())
+
+	retention, err := jaeger_mongodb.NewRetention(config.MongoSpanTTLDuration, config.MongoServiceTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection := db.Collection("spans")
+	writer := jaeger_mongodb.NewSpanWriter(collection, nil, maxBinaryValueSize).WithRetention(retention)
+	start := time.Date(2021, 7, 1, 1, 1, 1, 0, time.UTC)
+	for i, service := range []string{"payments", "frontend"} {
+		err := writer.WriteSpan(ctx, &model.Span{
+			TraceID:       model.NewTraceID(1, 1),
+			SpanID:        model.NewSpanID(uint64(i + 1)),
+			OperationName: "GET /",
+			StartTime:     start,
+			Process:       &model.Process{ServiceName: service},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for service, ttl := range map[string]time.Duration{"payments": 720 * time.Hour, "frontend": time.Hour} {
+		var span jaeger_mongodb.Span
+		if err := collection.FindOne(ctx, bson.D{{Key: "process.serviceName", Value: service}}).Decode(&span); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, start.Add(ttl), span.ExpireAt.UTC(), service)
+	}
+
+	// The _id does not depend on the retention, so a span replayed after
+	// the retention changed is not stored twice.
+	err = jaeger_mongodb.NewSpanWriter(collection, nil, maxBinaryValueSize).WriteSpan(ctx, &model.Span{
+		TraceID:       model.NewTraceID(1, 1),
+		SpanID:        model.NewSpanID(1),
+		OperationName: "GET /",
+		StartTime:     start,
+		Process:       &model.Process{ServiceName: "payments"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := collection.CountDocuments(ctx, bson.D{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(2), n)
+
+	config.MongoLayout = "timeseries"
+	_, err = jaeger_mongodb.Bootstrap(ctx, db, config)
+	assert.ErrorIs(t, err, jaeger_mongodb.ErrPerServiceTimeSeries)
+}